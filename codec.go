@@ -0,0 +1,31 @@
+package poly
+
+import "encoding/json"
+
+// Codec encodes and decodes values for Marshal and Unmarshal. The pre-pass follows the struct tag and
+// field naming rules of encoding/json, so a codec has to follow them as well, as json-iterator's
+// ConfigCompatibleWithStandardLibrary or sonic's standard config do. Registered method interfaces in
+// map values are only decoded when Unmarshal reports them with a *json.UnmarshalTypeError and carries on
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// stdCodec is the Codec backed by encoding/json
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// codec returns Codec, or encoding/json when it is not set
+func (p *Poly) codec() Codec {
+	if p.Codec == nil {
+		return stdCodec{}
+	}
+	return p.Codec
+}
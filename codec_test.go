@@ -0,0 +1,42 @@
+package poly
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingCodec delegates to encoding/json and counts the calls
+type countingCodec struct {
+	marshals   int
+	unmarshals int
+}
+
+func (c *countingCodec) Marshal(v any) ([]byte, error) {
+	c.marshals++
+	return json.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v any) error {
+	c.unmarshals++
+	return json.Unmarshal(data, v)
+}
+
+func TestCodec(t *testing.T) {
+	codec := &countingCodec{}
+	poly := Poly{Codec: codec}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	buf, err := poly.Marshal(&Request{Shape: &Circle{Radius: 1}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"circle","radius":1}}`, string(buf))
+	require.Equal(t, 1, codec.marshals)
+
+	// map entries are restored through the codec too
+	m := map[string]Shape{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"a":{"type":"circle","radius":2}}`), &m, true))
+	require.Equal(t, map[string]Shape{"a": &Circle{Type: "circle", Radius: 2}}, m)
+	require.Equal(t, 2, codec.unmarshals)
+}
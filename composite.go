@@ -0,0 +1,171 @@
+package poly
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// DiscriminantFields makes the discriminant a composite of the sibling fields at the given paths, for
+// variants that only several fields tell apart, e.g. DiscriminantFields("kind", "sub"). Structs are then
+// registered with a slice or array of one value per field, in the same order, e.g. []any{"shape", "circle"},
+// all fields are stamped on marshal and all must match on unmarshal. A field missing in the JSON matches
+// the zero value. Pass an empty discriminantFieldName with it. DiscriminantFirst does not apply
+func DiscriminantFields(fieldNames ...string) InterfaceOption {
+	return func(t *polyType) {
+		t.compositeFields = append([]string{}, fieldNames...)
+	}
+}
+
+// checkComposite checks the options of an interface registered with DiscriminantFields
+func (p *Poly) checkComposite(entry *polyType) error {
+	if len(entry.compositeFields) == 0 {
+		return errors.New("poly: DiscriminantFields needs at least one field")
+	}
+	if entry.discriminantFieldName != "" {
+		return errors.New("poly: pass an empty discriminantFieldName with DiscriminantFields")
+	}
+	if entry.externallyTagged || entry.discriminantQuery != "" {
+		return errors.New("poly: DiscriminantFields cannot be combined with ExternallyTagged or DiscriminantQuery")
+	}
+	return nil
+}
+
+// compositeFieldIndexes returns the index paths of the composite discriminant fields in structType,
+// checking that value holds one discriminant value per field
+func (p *Poly) compositeFieldIndexes(entry *polyType, structType reflect.Type, value any) ([][]int, error) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Len() != len(entry.compositeFields) {
+		return nil, fmt.Errorf("poly: composite discriminant of interface %s needs %d values, got %#v",
+			p.typeKey(entry.fieldType), len(entry.compositeFields), value)
+	}
+	indexes := make([][]int, len(entry.compositeFields))
+	for i, field := range entry.compositeFields {
+		index, fieldType, err := p.discriminantFieldIndex(entry, structType, field)
+		if errors.Is(err, errDiscriminantNotFound) {
+			return nil, fmt.Errorf("poly: discriminant field %s of interface %s not found in struct %s, %s",
+				field, p.typeKey(entry.fieldType), structType, p.missingFieldHint(entry, structType, field))
+		} else if err != nil {
+			return nil, err
+		}
+		if fieldValue := v.Index(i).Interface(); !p.discriminantAssignable(fieldValue, fieldType) {
+			return nil, fmt.Errorf("poly: discriminant value %#v of struct %s cannot be stored in its field %s of type %s",
+				fieldValue, structType, field, fieldType)
+		}
+		indexes[i] = index
+	}
+	return indexes, nil
+}
+
+// matchComposite returns the position of the struct whose composite discriminant matches the fields of
+// the object node, or -1 when there is none
+func (p *Poly) matchComposite(entry *polyType, node jsonNode) int {
+	if !p.compositeExists(entry, node) {
+		return p.absentMatch(entry)
+	}
+	nodes := make([]jsonNode, len(entry.compositeFields))
+	for i, field := range entry.compositeFields {
+		nodes[i] = p.lookup(node, field)
+	}
+	for pos, dVal := range entry.structValues {
+		dv := reflect.ValueOf(dVal)
+		matched := true
+		for i, n := range nodes {
+			if !p.nodeMatches(n, dv.Index(i).Interface()) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return pos
+		}
+	}
+	return -1
+}
+
+// compositeExists reports whether the object node carries any field of the composite discriminant
+func (p *Poly) compositeExists(entry *polyType, node jsonNode) bool {
+	for _, field := range entry.compositeFields {
+		if p.lookup(node, field).Exists() {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeMatches reports whether the discriminant node read from JSON matches the registered value dVal
+// the way matchNode compares them. A missing node matches the zero value
+func (p *Poly) nodeMatches(n jsonNode, dVal any) bool {
+	if !n.Exists() {
+		v := reflect.ValueOf(dVal)
+		return !v.IsValid() || v.IsZero()
+	}
+	if s, ok := n.Str(); ok {
+		v := reflect.ValueOf(dVal)
+		return v.Kind() == reflect.String && v.Type() != jsonNumberType && v.String() == s
+	}
+	if p.jsonKind(n) == "number" {
+		exact, isInt := new(big.Int).SetString(n.Raw(), 10)
+		return p.numberMatches(exact, isInt, n.Value(), dVal)
+	}
+	return p.discriminantMatches(n.Value(), dVal)
+}
+
+// compositeZero reports whether every value of the composite discriminant v is the zero value
+func (p *Poly) compositeZero(v reflect.Value) bool {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Interface && !elem.IsNil() {
+			elem = elem.Elem()
+		}
+		if !elem.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// stampComposite sets the composite discriminant fields of the struct val to the registered values
+// at pos, or to their zero values when clear is set
+func (p *Poly) stampComposite(val reflect.Value, entry *polyType, pos int, clear bool) error {
+	values := reflect.ValueOf(entry.structValues[pos])
+	for i, index := range entry.structCompositePos[pos] {
+		field := p.discriminantField(val, index, !clear)
+		if clear && !field.IsValid() {
+			continue
+		}
+		if !field.CanSet() {
+			return fmt.Errorf("poly: cannot set discriminant field %s of struct %s",
+				entry.compositeFields[i], entry.structTypes[pos])
+		}
+		if clear {
+			field.Set(reflect.Zero(field.Type()))
+		} else {
+			field.Set(p.discriminantValue(values.Index(i).Interface(), field.Type()))
+		}
+	}
+	return nil
+}
+
+// compositeDiffers returns the composite discriminant the struct val already carries, and whether
+// one of its fields is set to another value than the registered one at pos. Zero fields are stamped
+func (p *Poly) compositeDiffers(val reflect.Value, entry *polyType, pos int) (any, bool) {
+	values := reflect.ValueOf(entry.structValues[pos])
+	current := make([]any, len(entry.compositeFields))
+	differs := false
+	for i, index := range entry.structCompositePos[pos] {
+		field := p.discriminantField(val, index, false)
+		if !field.IsValid() {
+			continue
+		}
+		current[i] = p.fieldDiscriminant(field)
+		if !field.IsZero() && !p.discriminantMatches(current[i], values.Index(i).Interface()) {
+			differs = true
+		}
+	}
+	return current, differs
+}
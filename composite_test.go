@@ -0,0 +1,111 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// SubCircle is the circle shape of a two-field discriminant
+type SubCircle struct {
+	Kind   string  `json:"kind"`
+	Sub    string  `json:"sub"`
+	Radius float64 `json:"radius"`
+}
+
+// SubRect is the rectangle shape of a two-field discriminant
+type SubRect struct {
+	Kind  string  `json:"kind"`
+	Sub   string  `json:"sub"`
+	Width float64 `json:"width"`
+}
+
+// SubStamp is a circular stamp tool, sharing its sub-kind with SubCircle
+type SubStamp struct {
+	Kind string `json:"kind"`
+	Sub  string `json:"sub"`
+	Ink  string `json:"ink"`
+}
+
+func TestCompositeDiscriminant(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "", DiscriminantFields("kind", "sub")))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*SubCircle)(nil), []any{"shape", "circle"}))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*SubRect)(nil), []any{"shape", "rect"}))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*SubStamp)(nil), [2]string{"tool", "circle"}))
+	require.NoError(t, poly.Validate())
+
+	req := &RequestWithSlice{Shapes: []Shape{&SubCircle{Radius: 1}, &SubRect{Width: 2}, &SubStamp{Ink: "red"}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[
+		{"kind":"shape","sub":"circle","radius":1},
+		{"kind":"shape","sub":"rect","width":2},
+		{"kind":"tool","sub":"circle","ink":"red"}
+	]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req, req2)
+
+	// neither field alone tells the variants apart
+	buf = []byte(`{"shapes":[{"sub":"circle","kind":"tool"},{"kind":"tool","sub":"rect"}]}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &RequestWithSlice{}, true), &resolveErr)
+	require.Equal(t, "shapes.1.kind", resolveErr.Path)
+	require.Equal(t, []any{"tool", "rect"}, resolveErr.Value)
+
+	typ, value, err := poly.ResolveType((*Shape)(nil), []byte(`{"kind":"shape","sub":"rect"}`))
+	require.NoError(t, err)
+	require.Equal(t, "SubRect", typ.Name())
+	require.Equal(t, []any{"shape", "rect"}, value)
+
+	// a missing field matches the zero value
+	var partial Poly
+	require.NoError(t, partial.RegisterInterface((*Shape)(nil), "", DiscriminantFields("kind", "sub")))
+	require.NoError(t, partial.RegisterStruct((*Shape)(nil), (*SubCircle)(nil), []any{"shape", ""}))
+	require.NoError(t, partial.RegisterStruct((*Shape)(nil), (*SubRect)(nil), []any{"", ""}))
+	var shape Shape
+	require.NoError(t, partial.Unmarshal([]byte(`{"kind":"shape"}`), &shape, true))
+	require.Equal(t, &SubCircle{Kind: "shape"}, shape)
+	require.NoError(t, partial.Unmarshal([]byte(`{"width":1}`), &shape, true))
+	require.Equal(t, &SubRect{Width: 1}, shape)
+}
+
+func TestCompositeDiscriminantOptions(t *testing.T) {
+	shapes := []Shape{&SubCircle{Kind: "shape", Sub: "disc"}}
+	var strict Poly
+	require.NoError(t, strict.RegisterInterface((*Shape)(nil), "", ErrorOnDiscriminantMismatch(), DiscriminantFields("kind", "sub")))
+	require.NoError(t, strict.RegisterStruct((*Shape)(nil), (*SubCircle)(nil), []any{"shape", "circle"}))
+	_, err := strict.Marshal(shapes, true)
+	require.EqualError(t, err, `poly: discriminant []interface {}{"shape", "disc"} of struct poly.SubCircle differs from its registered value []interface {}{"shape", "circle"} at field path 0`)
+	var preserve Poly
+	require.NoError(t, preserve.RegisterInterface((*Shape)(nil), "", PreserveExistingDiscriminant(), DiscriminantFields("kind", "sub")))
+	require.NoError(t, preserve.RegisterStruct((*Shape)(nil), (*SubCircle)(nil), []any{"shape", "circle"}))
+	buf, err := preserve.Marshal(shapes, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"kind":"shape","sub":"disc","radius":0}]`, string(buf))
+
+	var registry Poly
+	require.NoError(t, registry.RegisterInterface((*Shape)(nil), "", DiscriminantFields("kind", "sub")))
+	require.NoError(t, registry.RegisterFromStruct((*Shape)(nil), struct {
+		Circle *SubCircle `poly:"[\"shape\",\"circle\"]"`
+		Stamp  *SubStamp  `poly:"[\"tool\",\"circle\"]"`
+	}{}))
+	var shape Shape
+	require.NoError(t, registry.Unmarshal([]byte(`{"kind":"tool","sub":"circle"}`), &shape, true))
+	require.Equal(t, &SubStamp{Kind: "tool", Sub: "circle"}, shape)
+
+	err = registry.RegisterStruct((*Shape)(nil), (*SubRect)(nil), "rect")
+	require.EqualError(t, err, `poly: composite discriminant of interface github.com/reyoung/poly.Shape needs 2 values, got "rect"`)
+	err = registry.RegisterStruct((*Shape)(nil), (*Circle)(nil), []any{"shape", "round"})
+	require.EqualError(t, err, "poly: discriminant field kind of interface github.com/reyoung/poly.Shape not found in struct poly.Circle, json fields of poly.Circle are radius, type")
+
+	var invalid Poly
+	err = invalid.RegisterInterface((*Shape)(nil), "type", DiscriminantFields("kind", "sub"))
+	require.EqualError(t, err, "poly: pass an empty discriminantFieldName with DiscriminantFields")
+	err = invalid.RegisterInterface((*Shape)(nil), "", DiscriminantFields("kind"), ExternallyTagged())
+	require.ErrorContains(t, err, "cannot be combined")
+	err = invalid.RegisterInterface((*Shape)(nil), "", DiscriminantFields())
+	require.EqualError(t, err, "poly: DiscriminantFields needs at least one field")
+}
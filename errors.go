@@ -0,0 +1,24 @@
+package poly
+
+import "fmt"
+
+// ResolveError reports an interface whose concrete type cannot be resolved from the JSON document
+type ResolveError struct {
+	// Interface is the registered name of the interface, its package path and type name
+	Interface string
+
+	// Path is the fully qualified dotted JSON field path of the discriminant,
+	// or of the wrapping object for externally tagged interfaces
+	Path string
+
+	// Value is the discriminant read from the document, nil when it is absent
+	Value any
+
+	// Raw is the raw JSON of the object the interface is resolved from
+	Raw string
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("poly: cannot resolve interface %s type by field path %s, value %#v, raw json %s",
+		e.Interface, e.Path, e.Value, e.Raw)
+}
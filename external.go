@@ -0,0 +1,58 @@
+package poly
+
+import "reflect"
+
+// externalVariant finds the registered struct of an externally tagged interface by the key of the
+// object node, and returns its position in entry together with the key and the nested object.
+// For tuple tagged interfaces node is the array pairing the discriminant with the nested object,
+// and the index of the object is returned as the key
+func (p *Poly) externalVariant(entry *polyType, node jsonNode) (int, string, jsonNode) {
+	matched, name, inner := -1, "", jsonNode{}
+	if entry.tupleTagged {
+		elems := node.Array()
+		if !node.IsArray() || len(elems) != 2 {
+			return matched, name, inner
+		}
+		key, ok := elems[0].Str()
+		if !ok {
+			return matched, name, inner
+		}
+		for pos, dVal := range entry.structValues {
+			if p.discriminantMatches(key, dVal) {
+				return pos, "1", elems[1]
+			}
+		}
+		return matched, name, inner
+	}
+	node.ForEach(func(key string, value jsonNode) bool {
+		for pos, dVal := range entry.structValues {
+			if p.discriminantMatches(key, dVal) {
+				matched, name, inner = pos, key, value
+				return false
+			}
+		}
+		return true
+	})
+	return matched, name, inner
+}
+
+// decodeExternal records decoding the nested object node of an externally tagged interface into refVal,
+// the struct pointer resolved for it, since json.Unmarshal decodes the wrapping object into it instead.
+// json.Unmarshal cannot decode the array of a tuple tagged interface into the struct, so iFaceVal is left
+// nil for it, the array is decoded later as null, and refVal is only stored in iFaceVal once decoded
+func (p *Poly) decodeExternal(state *unmarshalState, entry *polyType, iFaceVal reflect.Value, node jsonNode, refVal reflect.Value) {
+	if entry.tupleTagged {
+		iFaceVal.Set(reflect.Zero(iFaceVal.Type()))
+		state.decodeNull(state.path[:len(state.path)-1])
+	}
+	later := state.decodeLater(state.path)
+	state.fixups = append(state.fixups, func() error {
+		if err := p.decode([]byte(node.Raw()), refVal.Interface(), later.inner()); err != nil {
+			return err
+		}
+		if entry.tupleTagged {
+			iFaceVal.Set(refVal)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,135 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Pet is a sample interface tagged externally, its implementations have no discriminant field
+type Pet interface {
+	Sound() string
+}
+
+// Cat is a Pet without nested pets
+type Cat struct {
+	Name string `json:"name"`
+}
+
+func (c *Cat) Sound() string { return "meow" }
+
+// Dog is a Pet holding more pets
+type Dog struct {
+	Name    string `json:"name"`
+	Friends []Pet  `json:"friends"`
+}
+
+func (d *Dog) Sound() string { return "woof" }
+
+// Household holds externally tagged pets in a field, a slice and a map
+type Household struct {
+	Pet     Pet            `json:"pet"`
+	Pets    []Pet          `json:"pets"`
+	ByOwner map[string]Pet `json:"by_owner"`
+}
+
+func TestExternallyTagged(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Dog)(nil), "dog"))
+
+	h := &Household{Pet: &Cat{Name: "tom"}}
+	buf, err := poly.Marshal(h, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pet":{"cat":{"name":"tom"}},"pets":null,"by_owner":null}`, string(buf))
+
+	h2 := &Household{}
+	require.NoError(t, poly.Unmarshal(buf, h2, true))
+	require.Equal(t, h, h2)
+}
+
+func TestExternallyTaggedNested(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Dog)(nil), "dog"))
+
+	h := &Household{
+		Pet:  &Dog{Name: "rex", Friends: []Pet{&Cat{Name: "tom"}, &Dog{Name: "fido"}}},
+		Pets: []Pet{&Cat{Name: "kitty"}},
+		ByOwner: map[string]Pet{
+			"a.b": &Dog{Name: "spot", Friends: []Pet{&Cat{Name: "felix"}}},
+		},
+	}
+	buf, err := poly.Marshal(h, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"pet":{"dog":{"name":"rex","friends":[{"cat":{"name":"tom"}},{"dog":{"name":"fido","friends":null}}]}},
+		"pets":[{"cat":{"name":"kitty"}}],
+		"by_owner":{"a.b":{"dog":{"name":"spot","friends":[{"cat":{"name":"felix"}}]}}}
+	}`, string(buf))
+
+	h2 := &Household{}
+	require.NoError(t, poly.Unmarshal(buf, h2, true))
+	require.Equal(t, h, h2)
+}
+
+func TestExternallyTaggedErrors(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Dog)(nil), "dog"))
+	require.ErrorContains(t, poly.RegisterStruct((*Pet)(nil), (*Cat)(nil), 1),
+		"poly: externally tagged interface github.com/reyoung/poly.Pet needs a string key, got int")
+
+	err := poly.Unmarshal([]byte(`{"pet":{"cow":{}}}`), &Household{}, true)
+	require.ErrorContains(t, err, "poly: cannot resolve interface github.com/reyoung/poly.Pet type by field path pet, value <nil>")
+
+	h := &Household{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"pet":null}`), h, true))
+	require.Nil(t, h.Pet)
+}
+
+func TestTupleTagged(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Pet)(nil), "", TupleTagged()))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	require.NoError(t, poly.RegisterStruct((*Pet)(nil), (*Dog)(nil), "dog"))
+
+	h := &Household{
+		Pet:  &Dog{Name: "rex", Friends: []Pet{&Cat{Name: "tom"}, &Dog{Name: "fido"}}},
+		Pets: []Pet{&Cat{Name: "kitty"}},
+		ByOwner: map[string]Pet{
+			"a": &Dog{Name: "spot", Friends: []Pet{&Cat{Name: "felix"}}},
+		},
+	}
+	buf, err := poly.Marshal(h, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"pet":["dog",{"name":"rex","friends":[["cat",{"name":"tom"}],["dog",{"name":"fido","friends":null}]]}],
+		"pets":[["cat",{"name":"kitty"}]],
+		"by_owner":{"a":["dog",{"name":"spot","friends":[["cat",{"name":"felix"}]]}]}
+	}`, string(buf))
+
+	h2 := &Household{}
+	require.NoError(t, poly.Unmarshal(buf, h2, true))
+	require.Equal(t, h, h2)
+
+	typ, value, err := poly.ResolveType((*Pet)(nil), []byte(`["cat",{}]`))
+	require.NoError(t, err)
+	require.Equal(t, "Cat", typ.Name())
+	require.Equal(t, "cat", value)
+
+	// anything but a pair with a known discriminant is left unresolved
+	for _, doc := range []string{`{"pet":["cow",{}]}`, `{"pet":["cat"]}`, `{"pet":{"cat":{}}}`, `{"pet":[1,{}]}`} {
+		var resolveErr *ResolveError
+		require.ErrorAs(t, poly.Unmarshal([]byte(doc), &Household{}, true), &resolveErr, doc)
+		require.Equal(t, "pet", resolveErr.Path)
+	}
+
+	var resolveErr *ResolveError
+	err = poly.Unmarshal([]byte(`{"pet":["dog",{"friends":[["cow",{}]]}]}`), &Household{}, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "pet.1.friends.0", resolveErr.Path)
+}
@@ -0,0 +1,125 @@
+package poly
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// presenceRule selects a struct registered with RegisterStructPresence
+type presenceRule struct {
+	// pos is the position of the struct in the interface entry
+	pos int
+
+	// fieldPath is the dotted JSON field path whose presence selects the struct
+	fieldPath string
+}
+
+// RegisterStructFallback registers a struct implementation for an interface that carries no discriminant,
+// such as a legacy variant told apart by position, while the other structs of the interface do. It needs no
+// discriminant field and is marshaled as it is. Unmarshal resolves it only when the discriminant, absent or
+// unknown, matches no other registered struct, before IgnoreUnknown and ModeLenient are considered.
+// An interface has at most one fallback struct
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// structPtr: a pointer to the struct type (e.g., (*LegacyShape)(nil))
+func (p *Poly) RegisterStructFallback(iFacePtr any, structPtr any) error {
+	entry, structType, err := p.discriminantlessEntry(iFacePtr, structPtr, "fallback")
+	if err != nil {
+		return err
+	}
+	if entry.fallbackStruct != nil {
+		return fmt.Errorf("poly: interface %s already has the fallback struct %s", p.typeKey(entry.fieldType), entry.fallbackStruct)
+	}
+	entry.fallbackStruct = structType
+	p.appendDiscriminantless(entry, structType)
+	return nil
+}
+
+// RegisterStructPresence registers a struct implementation for an interface that carries no discriminant
+// but always has the field at fieldPath, which no other struct of the interface has, e.g. a legacy variant
+// with a `legacyId`. Like RegisterStructFallback it needs no discriminant field and is marshaled as it is.
+// Unmarshal resolves it for objects without a discriminant holding the field, before DefaultStruct and the
+// struct registered with the zero discriminant value. Presence rules are tried in the order they were registered
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// structPtr: a pointer to the struct type (e.g., (*LegacyShape)(nil))
+// fieldPath: the dotted JSON field path of the field (e.g., "legacyId")
+func (p *Poly) RegisterStructPresence(iFacePtr any, structPtr any, fieldPath string) error {
+	if fieldPath == "" {
+		return errors.New("poly: RegisterStructPresence needs a field path")
+	}
+	entry, structType, err := p.discriminantlessEntry(iFacePtr, structPtr, "presence")
+	if err != nil {
+		return err
+	}
+	entry.presence = append(entry.presence, presenceRule{pos: len(entry.structTypes), fieldPath: fieldPath})
+	p.appendDiscriminantless(entry, structType)
+	return nil
+}
+
+// discriminantlessEntry returns the registered interface of iFacePtr and the struct type of structPtr,
+// checking the interface can hold a struct without a discriminant of the kind named by kind
+func (p *Poly) discriminantlessEntry(iFacePtr any, structPtr any, kind string) (*polyType, reflect.Type, error) {
+	structType, err := p.structType(structPtr)
+	if err != nil {
+		return nil, nil, err
+	}
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !reflect.PointerTo(structType).Implements(iFaceType) {
+		return nil, nil, errors.New("poly: interface type mismatch, struct ptr must implements interface")
+	}
+	key := p.typeKey(iFaceType)
+	entry, ok := p.types[iFaceType]
+	if !ok {
+		return nil, nil, fmt.Errorf("poly: interface type %s not registered", key)
+	}
+	if entry.compositeFields != nil || entry.externallyTagged || entry.singleStruct || entry.discriminantMethod != "" ||
+		entry.normalize != nil || entry.requireDiscriminant {
+		return nil, nil, fmt.Errorf("poly: interface %s cannot have a %s struct with its options", key, kind)
+	}
+	return entry, structType, nil
+}
+
+// appendDiscriminantless adds the registration of structType, which has no discriminant, to entry
+func (p *Poly) appendDiscriminantless(entry *polyType, structType reflect.Type) {
+	p.appendStruct(entry, structType, nil, func() any {
+		return reflect.New(structType).Interface()
+	}, nil, nil, nil)
+}
+
+// discriminantless reports whether the struct at position pos of entry was registered without
+// a discriminant, with RegisterStructFallback or RegisterStructPresence
+func (p *Poly) discriminantless(entry *polyType, pos int) bool {
+	if entry.structTypes[pos] == entry.fallbackStruct {
+		return true
+	}
+	for _, rule := range entry.presence {
+		if rule.pos == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackMatch returns the position of the fallback struct of entry, or -1 when there is none
+func (p *Poly) fallbackMatch(entry *polyType) int {
+	for pos, structType := range entry.structTypes {
+		if structType == entry.fallbackStruct {
+			return pos
+		}
+	}
+	return -1
+}
+
+// presenceMatch returns the position of the first struct registered with RegisterStructPresence
+// whose field the object node holds, or -1 when there is none
+func (p *Poly) presenceMatch(entry *polyType, node jsonNode) int {
+	for _, rule := range entry.presence {
+		if p.lookup(node, rule.fieldPath).Exists() {
+			return rule.pos
+		}
+	}
+	return -1
+}
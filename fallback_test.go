@@ -0,0 +1,103 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// LegacyShape is an old Shape variant without a discriminant field
+type LegacyShape struct {
+	Points []float64 `json:"points"`
+}
+
+func TestRegisterStructFallback(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStructFallback((*Shape)(nil), (*LegacyShape)(nil)))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+
+	req := &RequestWithSlice{Shapes: []Shape{&Circle{Radius: 1}, &LegacyShape{Points: []float64{1, 2}}, &Rect{Width: 3}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[
+		{"type":"circle","radius":1},
+		{"points":[1,2]},
+		{"type":"rect","width":3,"height":0}
+	]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, []Shape{
+		&Circle{Type: "circle", Radius: 1}, &LegacyShape{Points: []float64{1, 2}}, &Rect{Type: "rect", Width: 3},
+	}, req2.Shapes)
+
+	// unknown discriminants fall back too
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":[{"type":"oval","points":[3]}]}`), req2, true))
+	require.Equal(t, []Shape{&LegacyShape{Points: []float64{3}}}, req2.Shapes)
+
+	typ, value, err := poly.ResolveType((*Shape)(nil), []byte(`{"points":[]}`))
+	require.NoError(t, err)
+	require.Equal(t, "LegacyShape", typ.Name())
+	require.Nil(t, value)
+
+	schema, err := poly.JSONSchema((*Shape)(nil))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"type": "object"}, schema["$defs"].(map[string]any)["LegacyShape"])
+	require.Len(t, schema["discriminator"].(map[string]any)["mapping"], 2)
+}
+
+func TestRegisterStructFallbackErrors(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStructFallback((*Shape)(nil), (*LegacyShape)(nil)))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	err := poly.RegisterStructFallback((*Shape)(nil), (*Square)(nil))
+	require.EqualError(t, err, "poly: interface github.com/reyoung/poly.Shape already has the fallback struct poly.LegacyShape")
+	err = poly.RegisterStructFallback((*Measurable)(nil), (*Disk)(nil))
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Measurable not registered")
+
+	external := &Poly{}
+	require.NoError(t, external.RegisterInterface((*Shape)(nil), "", ExternallyTagged()))
+	err = external.RegisterStructFallback((*Shape)(nil), (*LegacyShape)(nil))
+	require.ErrorContains(t, err, "cannot have a fallback struct")
+}
+
+// LegacyRect is an old Shape variant told apart by its legacy id instead of a discriminant
+type LegacyRect struct {
+	LegacyID int     `json:"legacyId"`
+	Width    float64 `json:"width"`
+}
+
+func TestRegisterStructPresence(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStructFallback((*Shape)(nil), (*LegacyShape)(nil)))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.RegisterStructPresence((*Shape)(nil), (*LegacyRect)(nil), "legacyId"))
+	require.NoError(t, poly.Validate())
+
+	req := &RequestWithSlice{Shapes: []Shape{&Circle{Radius: 1}, &LegacyRect{LegacyID: 7, Width: 2}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"type":"circle","radius":1},{"legacyId":7,"width":2}]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle", Radius: 1}, &LegacyRect{LegacyID: 7, Width: 2}}, req2.Shapes)
+
+	// the field only selects the struct when the discriminant is absent, and objects
+	// with neither go to the fallback struct
+	buf = []byte(`{"shapes":[{"type":"circle","legacyId":1},{"points":[1]},{"legacyId":null}]}`)
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, []Shape{
+		&Circle{Type: "circle"}, &LegacyShape{Points: []float64{1}}, &LegacyRect{},
+	}, req2.Shapes)
+
+	require.EqualError(t, poly.RegisterStructPresence((*Shape)(nil), (*LegacyRect)(nil), ""),
+		"poly: RegisterStructPresence needs a field path")
+}
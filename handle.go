@@ -0,0 +1,127 @@
+package poly
+
+import "reflect"
+
+// Handle records the structs registered through it, so Unregister removes exactly those and no others,
+// e.g. the variants of a plugin when it is unloaded. Interfaces stay registered
+type Handle struct {
+	poly  *Poly
+	added []handleStruct
+}
+
+// handleStruct is a struct registration made through a Handle, id numbering it in the structIDs of entry
+type handleStruct struct {
+	entry *polyType
+	id    uint64
+}
+
+// NewHandle returns a Handle registering structs with p
+func (p *Poly) NewHandle() *Handle {
+	return &Handle{poly: p}
+}
+
+// RegisterStruct registers a struct implementation for an interface like Poly.RegisterStruct,
+// recording it to be removed by Unregister
+func (h *Handle) RegisterStruct(iFacePtr any, structPtr any, value any) error {
+	return h.record(iFacePtr, func() error {
+		return h.poly.RegisterStruct(iFacePtr, structPtr, value)
+	})
+}
+
+// RegisterStructFunc registers a struct implementation for an interface like Poly.RegisterStructFunc,
+// recording it to be removed by Unregister
+func (h *Handle) RegisterStructFunc(iFacePtr any, value any, creator func() any) error {
+	return h.record(iFacePtr, func() error {
+		return h.poly.RegisterStructFunc(iFacePtr, value, creator)
+	})
+}
+
+// RegisterStructMatch registers a struct implementation for an interface like Poly.RegisterStructMatch,
+// recording it to be removed by Unregister
+func (h *Handle) RegisterStructMatch(iFacePtr any, structPtr any, match func(any) bool, marshalValue any) error {
+	return h.record(iFacePtr, func() error {
+		return h.poly.RegisterStructMatch(iFacePtr, structPtr, match, marshalValue)
+	})
+}
+
+// record runs register and records the struct it added to the interface of iFacePtr
+func (h *Handle) record(iFacePtr any, register func() error) error {
+	if err := register(); err != nil {
+		return err
+	}
+	iFaceType, _ := h.poly.iFaceType(iFacePtr)
+	entry := h.poly.types[iFaceType]
+	h.added = append(h.added, handleStruct{entry: entry, id: entry.structIDs[len(entry.structIDs)-1]})
+	return nil
+}
+
+// Unregister removes the structs registered through h, leaving those registered otherwise, or through
+// other handles, in place. Later calls do nothing until more structs are registered through h.
+// It must not run concurrently with the other methods of the Poly
+func (h *Handle) Unregister() {
+	for i := len(h.added) - 1; i >= 0; i-- {
+		added := h.added[i]
+		if pos := h.poly.registeredPos(added); pos != -1 {
+			h.poly.removeStruct(added.entry, pos)
+		}
+	}
+	h.added = nil
+}
+
+// registeredPos returns the position of the registration added in its entry, or -1 when it was removed
+func (p *Poly) registeredPos(added handleStruct) int {
+	for pos, id := range added.entry.structIDs {
+		if id == added.id {
+			return pos
+		}
+	}
+	return -1
+}
+
+// removeStruct removes the struct at position pos from entry
+func (p *Poly) removeStruct(entry *polyType, pos int) {
+	structType := entry.structTypes[pos]
+	entry.structValues = append(entry.structValues[:pos:pos], entry.structValues[pos+1:]...)
+	entry.structMatchers = append(entry.structMatchers[:pos:pos], entry.structMatchers[pos+1:]...)
+	entry.structCreators = append(entry.structCreators[:pos:pos], entry.structCreators[pos+1:]...)
+	entry.structTypes = append(entry.structTypes[:pos:pos], entry.structTypes[pos+1:]...)
+	entry.structFieldPos = append(entry.structFieldPos[:pos:pos], entry.structFieldPos[pos+1:]...)
+	entry.structCompositePos = append(entry.structCompositePos[:pos:pos], entry.structCompositePos[pos+1:]...)
+	entry.structIDs = append(entry.structIDs[:pos:pos], entry.structIDs[pos+1:]...)
+
+	entry.hasMatchers = false
+	for _, match := range entry.structMatchers {
+		entry.hasMatchers = entry.hasMatchers || match != nil
+	}
+	var presence []presenceRule
+	for _, rule := range entry.presence {
+		if rule.pos == pos {
+			continue
+		}
+		if rule.pos > pos {
+			rule.pos--
+		}
+		presence = append(presence, rule)
+	}
+	entry.presence = presence
+	if entry.fallbackStruct == structType {
+		entry.fallbackStruct = nil
+	}
+	if p.structEntries[structType] == entry {
+		p.remapStruct(structType)
+	}
+}
+
+// remapStruct points structEntries at an interface structType is still registered for, the first
+// by name, or drops it when there is none
+func (p *Poly) remapStruct(structType reflect.Type) {
+	delete(p.structEntries, structType)
+	for _, entry := range p.sortedEntries() {
+		for _, t := range entry.structTypes {
+			if t == structType {
+				p.structEntries[structType] = entry
+				return
+			}
+		}
+	}
+}
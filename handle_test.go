@@ -0,0 +1,76 @@
+package poly
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleUnregister(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	plugin := poly.NewHandle()
+	require.NoError(t, plugin.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, plugin.RegisterStructMatch((*Shape)(nil), (*Square)(nil), func(v any) bool {
+		return v == "square" || v == "box"
+	}, "square"))
+	other := poly.NewHandle()
+	require.NoError(t, other.RegisterStruct((*Shape)(nil), (*Disk)(nil), "disk"))
+	require.Error(t, plugin.RegisterStruct((*Shape)(nil), (*Rect)(nil), 1))
+
+	buf := []byte(`{"shapes":[{"type":"circle"},{"type":"rect"},{"type":"box"},{"type":"disk"}]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle"}, &Rect{Type: "rect"}, &Square{Type: "box"}, &Disk{Type: "disk"}}, req.Shapes)
+
+	plugin.Unregister()
+	plugin.Unregister()
+	require.Equal(t, 2, poly.Stats().Structs)
+	require.NoError(t, poly.Validate())
+
+	// structs of the other handle and those registered directly still resolve
+	buf = []byte(`{"shapes":[{"type":"circle"},{"type":"disk"}]}`)
+	req = &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle"}, &Disk{Type: "disk"}}, req.Shapes)
+
+	for _, shape := range []string{"rect", "box"} {
+		var resolveErr *ResolveError
+		require.ErrorAs(t, poly.Unmarshal([]byte(`{"shape":{"type":"`+shape+`"}}`), &Request{}, true), &resolveErr, shape)
+	}
+	_, err := poly.Marshal(&Request{Shape: &Rect{}}, true)
+	require.Error(t, err)
+
+	// a struct can be registered again once unregistered
+	require.NoError(t, plugin.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	req = &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":[{"type":"rect"}]}`), req, true))
+	require.Equal(t, []Shape{&Rect{Type: "rect"}}, req.Shapes)
+
+	other.Unregister()
+	require.Equal(t, map[reflect.Type]int{reflect.TypeOf((*Shape)(nil)).Elem(): 2}, poly.Stats().Variants)
+}
+
+func TestHandleUnregisterOverlapping(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+
+	// both handles register the same struct with the same value, told apart only by their predicates
+	a := poly.NewHandle()
+	require.NoError(t, a.RegisterStructMatch((*Shape)(nil), (*Square)(nil), func(v any) bool { return v == "square" }, "square"))
+	b := poly.NewHandle()
+	require.NoError(t, b.RegisterStructMatch((*Shape)(nil), (*Square)(nil), func(v any) bool { return v == "box" }, "square"))
+
+	a.Unregister()
+	req := &Request{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"box"}}`), req, true))
+	require.Equal(t, &Square{Type: "box"}, req.Shape)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"shape":{"type":"square"}}`), &Request{}, true), &resolveErr)
+
+	b.Unregister()
+	require.Equal(t, 0, poly.Stats().Structs)
+}
@@ -0,0 +1,92 @@
+//go:build !polystdjson
+
+package poly
+
+import "github.com/tidwall/gjson"
+
+// jsonQueries reports whether Get evaluates gjson path expressions such as queries and modifiers
+const jsonQueries = true
+
+// jsonNode is a position in the JSON document walked by the unmarshal pre-pass, backed by gjson.
+// Build with the polystdjson tag to back it with encoding/json instead
+type jsonNode struct {
+	result gjson.Result
+}
+
+// parseJSON returns the root node of the document in buf, skipping a byte order mark. gjson parses lazily,
+// so malformed documents are left for json.Unmarshal to report
+func (p *Poly) parseJSON(buf []byte) (jsonNode, error) {
+	return jsonNode{result: gjson.ParseBytes(trimBOM(buf))}, nil
+}
+
+// Get returns the node at the dotted path below n
+func (n jsonNode) Get(path string) jsonNode {
+	return jsonNode{result: n.result.Get(path)}
+}
+
+// Member returns the member of an object node named name, taken literally rather than as a path
+func (n jsonNode) Member(name string) jsonNode {
+	return jsonNode{result: n.result.Get(gjson.Escape(name))}
+}
+
+// Str returns the value of a string node
+func (n jsonNode) Str() (string, bool) {
+	return n.result.Str, n.result.Type == gjson.String
+}
+
+// Exists reports whether the node is present in the document
+func (n jsonNode) Exists() bool {
+	return n.result.Exists()
+}
+
+// IsNull reports whether the node is a JSON null
+func (n jsonNode) IsNull() bool {
+	return n.result.Exists() && n.result.Type == gjson.Null
+}
+
+// IsArray reports whether the node is a JSON array
+func (n jsonNode) IsArray() bool {
+	return n.result.IsArray()
+}
+
+// IsObject reports whether the node is a JSON object
+func (n jsonNode) IsObject() bool {
+	return n.result.IsObject()
+}
+
+// Array returns the elements of an array node
+func (n jsonNode) Array() []jsonNode {
+	results := n.result.Array()
+	elems := make([]jsonNode, len(results))
+	for i, result := range results {
+		elems[i] = jsonNode{result: result}
+	}
+	return elems
+}
+
+// ForEach calls fn for every member of an object node in document order, until fn returns false
+func (n jsonNode) ForEach(fn func(name string, value jsonNode) bool) {
+	n.result.ForEach(func(key, value gjson.Result) bool {
+		return fn(key.String(), jsonNode{result: value})
+	})
+}
+
+// Value returns the node as a Go value: float64 numbers, strings, bools, nil,
+// map[string]any objects and []any arrays
+func (n jsonNode) Value() any {
+	return n.result.Value()
+}
+
+// Raw returns the raw JSON text of the node
+func (n jsonNode) Raw() string {
+	return n.result.Raw
+}
+
+// BeforeUnmarshalJSONResult is BeforeUnmarshalJSON for a document already parsed by gjson,
+// so callers querying the document themselves can share one parse with the pre-pass.
+// It is not available in builds with the polystdjson tag
+// root: the parsed JSON document
+// ptr: pointer to the value to populate
+func (p *Poly) BeforeUnmarshalJSONResult(root gjson.Result, ptr any, strict bool) error {
+	return p.beforeUnmarshalRoot(&unmarshalState{mode: modeOf(strict)}, ptr, jsonNode{result: root})
+}
@@ -0,0 +1,132 @@
+//go:build !polystdjson
+
+package poly
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestUnmarshalJSONResult(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	buf := []byte(`{"shapes":[{"type":"circle","radius":10},{"type":"rect","width":5,"height":3}]}`)
+	root := gjson.ParseBytes(buf)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.BeforeUnmarshalJSONResult(root, req, true))
+	require.Equal(t, int64(2), root.Get("shapes.#").Int())
+	require.NoError(t, json.Unmarshal(buf, req))
+	require.Equal(t, []Shape{&Circle{Type: "circle", Radius: 10}, &Rect{Type: "rect", Width: 5, Height: 3}}, req.Shapes)
+}
+
+// Attr is a key value pair of an attribute list carrying the discriminant
+type Attr struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// AttrCircle is a circle whose kind is one of its attributes
+type AttrCircle struct {
+	Attrs  []Attr  `json:"attrs"`
+	Radius float64 `json:"radius"`
+}
+
+// AttrRect is a rectangle whose kind is one of its attributes
+type AttrRect struct {
+	Attrs []Attr  `json:"attrs"`
+	Width float64 `json:"width"`
+}
+
+func TestDiscriminantQuery(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "", DiscriminantQuery(`attrs.#(key=="kind").value`)))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*AttrCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*AttrRect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+
+	buf := []byte(`{"shapes":[
+		{"attrs":[{"key":"color","value":"red"},{"key":"kind","value":"rect"}],"width":2},
+		{"attrs":[{"key":"kind","value":"circle"}],"radius":1}
+	]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&AttrRect{Attrs: []Attr{{"color", "red"}, {"kind", "rect"}}, Width: 2},
+		&AttrCircle{Attrs: []Attr{{"kind", "circle"}}, Radius: 1},
+	}, req.Shapes)
+
+	// the structs carry no discriminant field, they are marshaled as they are
+	out, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, string(buf), string(out))
+
+	buf = []byte(`{"shapes":[{"attrs":[{"key":"kind","value":"hexagon"}]}]}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &RequestWithSlice{}, true), &resolveErr)
+	require.Equal(t, `shapes.0.attrs.#(key=="kind").value`, resolveErr.Path)
+	require.Equal(t, "hexagon", resolveErr.Value)
+
+	// the field named by discriminantFieldName is still stamped on marshal
+	var stamped Poly
+	require.NoError(t, stamped.RegisterInterface((*Shape)(nil), "type", DiscriminantQuery(`meta|@reverse|0`)))
+	require.NoError(t, stamped.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	var shape Shape
+	require.NoError(t, stamped.Unmarshal([]byte(`{"meta":["old","circle"],"radius":3}`), &shape, true))
+	require.Equal(t, &Circle{Radius: 3}, shape)
+	out, err = stamped.Marshal(&shape, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"circle","radius":3}`, string(out))
+}
+
+// BenchmarkBeforeUnmarshalJSONQuery runs the pre-pass on raw bytes and then queries the document again
+func BenchmarkBeforeUnmarshalJSONQuery(b *testing.B) {
+	poly := newBenchPoly(b)
+	buf := sliceDocument(b, poly, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &RequestWithSlice{}
+		if err := poly.BeforeUnmarshalJSON(buf, req, true); err != nil {
+			b.Fatal(err)
+		}
+		if gjson.GetBytes(buf, "shapes.#").Int() != 1000 {
+			b.Fatal("unexpected length")
+		}
+	}
+}
+
+// BenchmarkBeforeUnmarshalJSONResultQuery shares one parsed document between the pre-pass and the query
+func BenchmarkBeforeUnmarshalJSONResultQuery(b *testing.B) {
+	poly := newBenchPoly(b)
+	buf := sliceDocument(b, poly, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root := gjson.ParseBytes(buf)
+		req := &RequestWithSlice{}
+		if err := poly.BeforeUnmarshalJSONResult(root, req, true); err != nil {
+			b.Fatal(err)
+		}
+		if root.Get("shapes.#").Int() != 1000 {
+			b.Fatal("unexpected length")
+		}
+	}
+}
+
+func TestResolveErrorPathQuery(t *testing.T) {
+	// gjson reads the segments of error paths as object keys or array indexes by the value they meet
+	poly := newShapePoly(t)
+	buf := []byte(`{"0":[{"type":"rect"},{"type":"square"}]}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &map[string][]Shape{}, true), &resolveErr)
+	require.Equal(t, "square", gjson.GetBytes(buf, resolveErr.Path).String())
+
+	buf = []byte(`{"a.b":{"0":{"type":"oval"}}}`)
+	require.ErrorAs(t, poly.Unmarshal(buf, &map[string]map[string]Shape{}, true), &resolveErr)
+	require.Equal(t, `a\.b.0.type`, resolveErr.Path)
+	require.Equal(t, "oval", gjson.GetBytes(buf, resolveErr.Path).String())
+}
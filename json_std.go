@@ -0,0 +1,212 @@
+//go:build polystdjson
+
+package poly
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// jsonValue is a parsed JSON value of the document tree built from encoding/json.Decoder tokens
+type jsonValue struct {
+	// raw is the raw JSON text of the value
+	raw string
+
+	// token is the scalar token of the value (nil, bool, json.Number or string),
+	// or the opening json.Delim of an object or array
+	token json.Token
+
+	// names are the member names of an object, in document order
+	names []string
+
+	// elems are the member values of an object, or the elements of an array
+	elems []*jsonValue
+}
+
+// jsonQueries reports whether Get evaluates gjson path expressions, this backend only follows dotted paths
+const jsonQueries = false
+
+// jsonNode is a position in the JSON document walked by the unmarshal pre-pass, backed by a tree of
+// encoding/json.Decoder tokens for builds with the polystdjson tag that leave out gjson. Paths are
+// dotted member names or array indexes, with `\` escaping a literal dot
+type jsonNode struct {
+	value *jsonValue
+}
+
+// parseJSON returns the root node of the document in buf, skipping a byte order mark
+func (p *Poly) parseJSON(buf []byte) (jsonNode, error) {
+	buf = trimBOM(buf)
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	value, err := parseJSONValue(dec, buf)
+	if err != nil {
+		return jsonNode{}, fmt.Errorf("poly: cannot parse json: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return jsonNode{}, errors.New("poly: cannot parse json: unexpected data after top-level value")
+	}
+	return jsonNode{value: value}, nil
+}
+
+// parseJSONValue reads the next value of the document buf from dec. The decoder bounds the
+// nesting depth as json.Unmarshal does, so the recursion stays shallow enough
+func parseJSONValue(dec *json.Decoder, buf []byte) (*jsonValue, error) {
+	start := valueStart(dec, buf)
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	value := &jsonValue{token: token}
+	switch token {
+	case json.Delim('{'):
+		for dec.More() {
+			name, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			elem, err := parseJSONValue(dec, buf)
+			if err != nil {
+				return nil, err
+			}
+			value.names = append(value.names, name.(string))
+			value.elems = append(value.elems, elem)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	case json.Delim('['):
+		for dec.More() {
+			elem, err := parseJSONValue(dec, buf)
+			if err != nil {
+				return nil, err
+			}
+			value.elems = append(value.elems, elem)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	value.raw = string(buf[start:dec.InputOffset()])
+	return value, nil
+}
+
+// Get returns the node at the dotted path below n
+func (n jsonNode) Get(path string) jsonNode {
+	value := n.value
+	for _, segment := range splitJSONPath(path) {
+		if value == nil {
+			break
+		}
+		value = value.member(segment)
+	}
+	return jsonNode{value: value}
+}
+
+// Member returns the member of an object node named name, taken literally rather than as a path
+func (n jsonNode) Member(name string) jsonNode {
+	if n.value == nil {
+		return jsonNode{}
+	}
+	return jsonNode{value: n.value.member(name)}
+}
+
+// member returns the first object member named segment, or the array element indexed by it
+func (v *jsonValue) member(segment string) *jsonValue {
+	switch v.token {
+	case json.Delim('{'):
+		for i, name := range v.names {
+			if name == segment {
+				return v.elems[i]
+			}
+		}
+	case json.Delim('['):
+		if i, err := strconv.Atoi(segment); err == nil && i >= 0 && i < len(v.elems) {
+			return v.elems[i]
+		}
+	}
+	return nil
+}
+
+// Str returns the value of a string node
+func (n jsonNode) Str() (string, bool) {
+	if n.value == nil {
+		return "", false
+	}
+	s, ok := n.value.token.(string)
+	return s, ok
+}
+
+// Exists reports whether the node is present in the document
+func (n jsonNode) Exists() bool {
+	return n.value != nil
+}
+
+// IsNull reports whether the node is a JSON null
+func (n jsonNode) IsNull() bool {
+	return n.value != nil && n.value.token == nil
+}
+
+// IsArray reports whether the node is a JSON array
+func (n jsonNode) IsArray() bool {
+	return n.value != nil && n.value.token == json.Delim('[')
+}
+
+// IsObject reports whether the node is a JSON object
+func (n jsonNode) IsObject() bool {
+	return n.value != nil && n.value.token == json.Delim('{')
+}
+
+// Array returns the elements of an array node
+func (n jsonNode) Array() []jsonNode {
+	if !n.IsArray() {
+		return nil
+	}
+	elems := make([]jsonNode, len(n.value.elems))
+	for i, elem := range n.value.elems {
+		elems[i] = jsonNode{value: elem}
+	}
+	return elems
+}
+
+// ForEach calls fn for every member of an object node in document order, until fn returns false
+func (n jsonNode) ForEach(fn func(name string, value jsonNode) bool) {
+	if !n.IsObject() {
+		return
+	}
+	for i, name := range n.value.names {
+		if !fn(name, jsonNode{value: n.value.elems[i]}) {
+			return
+		}
+	}
+}
+
+// Value returns the node as a Go value: float64 numbers, strings, bools, nil,
+// map[string]any objects and []any arrays
+func (n jsonNode) Value() any {
+	if n.value == nil {
+		return nil
+	}
+	switch token := n.value.token.(type) {
+	case json.Number:
+		f, _ := token.Float64()
+		return f
+	case json.Delim:
+		var v any
+		_ = json.Unmarshal([]byte(n.value.raw), &v)
+		return v
+	default:
+		return token
+	}
+}
+
+// Raw returns the raw JSON text of the node
+func (n jsonNode) Raw() string {
+	if n.value == nil {
+		return ""
+	}
+	return n.value.raw
+}
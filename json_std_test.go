@@ -0,0 +1,34 @@
+//go:build polystdjson
+
+package poly
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdJSONNode(t *testing.T) {
+	var poly Poly
+	root, err := poly.parseJSON([]byte(` {"a": {"b.c": [1, {"d": null}]}, "n": 1.5} `))
+	require.NoError(t, err)
+	require.Equal(t, `{"b.c": [1, {"d": null}]}`, root.Get("a").Raw())
+	require.Equal(t, `1`, root.Get(`a.b\.c.0`).Raw())
+	require.True(t, root.Get(`a.b\.c.1.d`).IsNull())
+	require.False(t, root.Get(`a.b\.c.2`).Exists())
+	require.Equal(t, 1.5, root.Get("n").Value())
+
+	_, err = poly.parseJSON([]byte(`{"a": 1} {}`))
+	require.Error(t, err)
+
+	deep := strings.Repeat("[", 20000) + strings.Repeat("]", 20000)
+	_, err = poly.parseJSON([]byte(deep))
+	require.ErrorContains(t, err, "exceeded max depth")
+}
+
+func TestStdJSONDiscriminantQuery(t *testing.T) {
+	var poly Poly
+	err := poly.RegisterInterface((*Shape)(nil), "", DiscriminantQuery(`attrs.#(key=="kind").value`))
+	require.EqualError(t, err, "poly: DiscriminantQuery needs the gjson backend; build without the polystdjson tag")
+}
@@ -0,0 +1,186 @@
+package poly
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// beforeUnmarshalMapEntry resolves the entry of map m named name in JSON, a member of the object node parent,
+// and stores it into the map.
+// It also records how to restore the entry once json.Unmarshal has decoded the map from scratch
+func (p *Poly) beforeUnmarshalMapEntry(state *unmarshalState, m reflect.Value, parent jsonNode, name string, node jsonNode, depth int) error {
+	state.descend(name, parent)
+	defer state.ascend()
+	key, err := p.mapKey(m.Type().Key(), name)
+	if err != nil {
+		return fmt.Errorf("poly: cannot use %q as map key of type %s at field path %s: %w",
+			name, m.Type().Key(), joinJSONPath(state.path), err)
+	}
+	elem := reflect.New(m.Type().Elem()).Elem()
+	later := state.decodeLater(state.path)
+	state.fixups = append(state.fixups, func() error {
+		if err := p.decode([]byte(node.Raw()), elem.Addr().Interface(), later.inner()); err != nil {
+			return err
+		}
+		// store the entry once the fixups of the values nested in it have run too
+		state.fixups = append(state.fixups, func() error {
+			m.SetMapIndex(key, elem)
+			return nil
+		})
+		return nil
+	})
+	if err := p.beforeUnmarshalJSONValue(state, elem, node, depth); err != nil {
+		return err
+	}
+	m.SetMapIndex(key, elem)
+	return nil
+}
+
+// beforeMarshalMapEntry prepares the entry of map m at key for marshaling. Map values are not
+// addressable, so interfaces, structs and arrays held by value are prepared on a copy stored back into the map
+func (p *Poly) beforeMarshalMapEntry(state *marshalState, m reflect.Value, key reflect.Value, elem reflect.Value, depth int) error {
+	switch elem.Kind() {
+	case reflect.Interface, reflect.Struct, reflect.Array:
+	default:
+		return p.beforeMarshalJSONValue(state, elem, depth)
+	}
+	elemCopy := reflect.New(elem.Type()).Elem()
+	elemCopy.Set(elem)
+	if err := p.beforeMarshalJSONValue(state, elemCopy, depth); err != nil {
+		return err
+	}
+	state.stamps = append(state.stamps, func() error {
+		state.saveMapIndex(m, key)
+		m.SetMapIndex(key, elemCopy)
+		return nil
+	})
+	return nil
+}
+
+// mapKey converts a JSON object key to a map key of type t the way encoding/json does:
+// through encoding.TextUnmarshaler, as a string, or as a decimal integer
+func (p *Poly) mapKey(t reflect.Type, name string) (reflect.Value, error) {
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		key := reflect.New(t)
+		if err := key.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(name)); err != nil {
+			return reflect.Value{}, err
+		}
+		return key.Elem(), nil
+	}
+	key := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		key.SetString(name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || key.OverflowInt(n) {
+			return reflect.Value{}, errors.New("invalid integer key")
+		}
+		key.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || key.OverflowUint(n) {
+			return reflect.Value{}, errors.New("invalid unsigned integer key")
+		}
+		key.SetUint(n)
+	default:
+		return reflect.Value{}, errors.New("unsupported key type")
+	}
+	return key, nil
+}
+
+// mapKeyName returns the JSON object key encoding/json writes for map key k:
+// the string itself, the output of encoding.TextMarshaler, or the decimal integer
+func (p *Poly) mapKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		buf, err := tm.MarshalText()
+		return string(buf), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("poly: unsupported map key type %s", k.Type())
+}
+
+// mayHoldInterface reports whether values of type t can contain interfaces resolved by the pre-pass,
+// so maps of plain data are left to encoding/json alone. seen guards against recursive types
+func (p *Poly) mayHoldInterface(t reflect.Type, seen map[reflect.Type]bool) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		// decoding into `any` needs no help unless it is registered or resolved by ResolveAny
+		_, ok := p.types[t]
+		return ok || !p.isAny(t) || p.anyInterface != nil
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		return p.mayHoldInterface(t.Elem(), seen)
+	case reflect.Struct:
+		if reflect.PointerTo(t).Implements(polyBinderType) {
+			return true
+		}
+		if seen[t] || p.unmarshalsItself(t) {
+			return false
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if p.isVisible(f) && p.mayHoldInterface(f.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decode unmarshals buf into ptr with the codec, decoding null in place of the values later marks.
+// Those are the values json.Unmarshal cannot decode, such as registered interfaces inside map values
+// it decodes from zero values, which the fixups decode on their own instead
+func (p *Poly) decode(buf []byte, ptr any, later *rewriteTrie) error {
+	if later.replace != "" || len(later.children) != 0 {
+		// a malformed document is left for the codec to report
+		if rewritten, err := p.applyRewrites(buf, later); err == nil {
+			buf = rewritten
+		}
+	}
+	return p.codec().Unmarshal(buf, ptr)
+}
+
+// decodeLater marks the value at path to be decoded by a fixup rather than by json.Unmarshal, and returns
+// its node in the trie of such values. The values marked below path are those of the document the fixup decodes
+func (s *unmarshalState) decodeLater(path []string) *rewriteTrie {
+	t := &s.later
+	t.fold = true
+	for _, segment := range path {
+		t = t.child(segment)
+	}
+	t.replace = "null"
+	return t
+}
+
+// decodeNull marks the value at path to be decoded as null, also when a fixup decodes it as a document
+// of its own, for interfaces json.Unmarshal cannot decode anywhere, such as those left unresolved
+func (s *unmarshalState) decodeNull(path []string) {
+	s.decodeLater(path).null = true
+}
+
+// inner returns the values to decode later inside the value of t, for decoding that value as a document of its own
+func (t *rewriteTrie) inner() *rewriteTrie {
+	inner := &rewriteTrie{children: t.children, fold: t.fold}
+	if t.null {
+		inner.replace = "null"
+	}
+	return inner
+}
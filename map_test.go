@@ -0,0 +1,304 @@
+package poly
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Point is a map key rendered through encoding.TextMarshaler
+type Point struct {
+	X, Y int
+}
+
+func (pt Point) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", pt.X, pt.Y)), nil
+}
+
+func (pt *Point) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "%d,%d", &pt.X, &pt.Y)
+	return err
+}
+
+// WrappedMeasurable decodes itself with encoding/json alone, which cannot decode the Measurable it holds
+type WrappedMeasurable struct {
+	M Measurable `json:"m"`
+}
+
+func (w *WrappedMeasurable) UnmarshalJSON(buf []byte) error {
+	type plain WrappedMeasurable
+	return json.Unmarshal(buf, (*plain)(w))
+}
+
+func TestIntKeyMap(t *testing.T) {
+	poly := newShapePoly(t)
+	type IntKeyRequest struct {
+		Shapes map[int]Shape `json:"shapes"`
+	}
+
+	req := &IntKeyRequest{Shapes: map[int]Shape{1: &Circle{Radius: 10}, -2: &Rect{Width: 5, Height: 3}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":{"1":{"type":"circle","radius":10},"-2":{"type":"rect","width":5,"height":3}}}`, string(buf))
+
+	req2 := &IntKeyRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, map[int]Shape{1: &Circle{Type: "circle", Radius: 10}, -2: &Rect{Type: "rect", Width: 5, Height: 3}}, req2.Shapes)
+
+	err = poly.Unmarshal([]byte(`{"shapes":{"one":{"type":"circle"}}}`), &IntKeyRequest{}, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `poly: cannot use "one" as map key of type int at field path shapes.one`)
+}
+
+func TestTextKeyMap(t *testing.T) {
+	poly := newShapePoly(t)
+	type TextKeyRequest struct {
+		Shapes map[Point]Shape `json:"shapes"`
+	}
+
+	req := &TextKeyRequest{Shapes: map[Point]Shape{{X: 1, Y: 2}: &Circle{Radius: 10}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shapes":{"1,2":{"type":"circle","radius":10}}}`, string(buf))
+
+	req2 := &TextKeyRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, map[Point]Shape{{X: 1, Y: 2}: &Circle{Type: "circle", Radius: 10}}, req2.Shapes)
+}
+
+func TestNestedMap(t *testing.T) {
+	poly := newShapePoly(t)
+	type NestedMapRequest struct {
+		Groups map[string]map[uint8]Shape `json:"groups"`
+	}
+
+	buf := []byte(`{"groups":{"a":{"1":{"type":"circle","radius":1}},"b":{"2":{"type":"rect","width":2}}}}`)
+	req := &NestedMapRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, map[string]map[uint8]Shape{
+		"a": {1: &Circle{Type: "circle", Radius: 1}},
+		"b": {2: &Rect{Type: "rect", Width: 2}},
+	}, req.Groups)
+}
+
+func TestPointerMapValues(t *testing.T) {
+	poly := newShapePoly(t)
+	type Container struct {
+		Shape  Shape   `json:"shape"`
+		Shapes []Shape `json:"shapes"`
+	}
+	type ContainerMapRequest struct {
+		Containers map[string]*Container `json:"containers"`
+	}
+
+	req := &ContainerMapRequest{Containers: map[string]*Container{
+		"a": {Shape: &Circle{Radius: 1}},
+		"b": {Shapes: []Shape{&Rect{Width: 2}}},
+		"c": nil,
+	}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"containers":{"a":{"shape":{"type":"circle","radius":1},"shapes":null},
+		"b":{"shape":null,"shapes":[{"type":"rect","width":2,"height":0}]},"c":null}}`, string(buf))
+
+	// the pointers held by the map are allocated before resolving the shapes behind them
+	decoded := &ContainerMapRequest{}
+	require.NoError(t, poly.Unmarshal(buf, decoded, true))
+	require.Equal(t, map[string]*Container{
+		"a": {Shape: &Circle{Type: "circle", Radius: 1}},
+		"b": {Shapes: []Shape{&Rect{Type: "rect", Width: 2}}},
+		"c": nil,
+	}, decoded.Containers)
+}
+
+func TestSliceMapSliceNesting(t *testing.T) {
+	poly := newShapePoly(t)
+	var paths []string
+	poly.OnResolve = func(path string, iface reflect.Type, chosen reflect.Type, value any) {
+		paths = append(paths, path)
+	}
+
+	groups := []map[string][]Shape{
+		{"key": {&Circle{Radius: 1}, &Rect{Width: 2}, &Circle{Radius: 3}}},
+		{"a": {&Rect{Height: 4}}, "b": nil},
+	}
+	buf, err := poly.Marshal(groups, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"key":[{"type":"circle","radius":1},{"type":"rect","width":2,"height":0},{"type":"circle","radius":3}]},
+		{"a":[{"type":"rect","width":0,"height":4}],"b":null}
+	]`, string(buf))
+
+	var groups2 []map[string][]Shape
+	require.NoError(t, poly.Unmarshal(buf, &groups2, true))
+	require.Equal(t, groups, groups2)
+	require.ElementsMatch(t, []string{"0.key.0", "0.key.1", "0.key.2", "1.a.0"}, paths)
+
+	var resolveErr *ResolveError
+	buf = []byte(`[{"key":[{"type":"circle"},{"type":"rect"},{"type":"square"}]}]`)
+	require.ErrorAs(t, poly.Unmarshal(buf, &groups2, true), &resolveErr)
+	require.Equal(t, "0.key.2.type", resolveErr.Path)
+	require.Equal(t, "square", resolveErr.Value)
+}
+
+func TestMethodInterfaceMap(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Square)(nil), "square"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+	type MeasurableMapRequest struct {
+		Items map[string]Measurable `json:"items"`
+	}
+
+	// json.Unmarshal alone cannot decode a method interface in a map value
+	buf := []byte(`{"items":{"a":{"type":"square","side":2},"b":{"type":"disk","radius":1}}}`)
+	req := &MeasurableMapRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, map[string]Measurable{
+		"a": &Square{Type: "square", Side: 2},
+		"b": &Disk{Type: "disk", Radius: 1},
+	}, req.Items)
+}
+
+func TestMapFixupsKeepOtherErrors(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+	type WrappedRequest struct {
+		Wrapped WrappedMeasurable     `json:"wrapped"`
+		Items   map[string]Measurable `json:"items"`
+	}
+
+	// the fixups decode the map entries, the interface the wrapper fails to decode is still reported
+	req := &WrappedRequest{}
+	err := poly.Unmarshal([]byte(`{"wrapped":{"m":{"type":"disk"}},"items":{"a":{"type":"disk"}}}`), req, true)
+	var typeErr *json.UnmarshalTypeError
+	require.ErrorAs(t, err, &typeErr)
+	require.Equal(t, reflect.TypeOf((*Measurable)(nil)).Elem(), typeErr.Type)
+
+	req = &WrappedRequest{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"wrapped":{"m":null},"items":{"a":{"type":"disk","radius":1}}}`), req, true))
+	require.Equal(t, map[string]Measurable{"a": &Disk{Type: "disk", Radius: 1}}, req.Items)
+}
+
+func TestAnyMapMarshal(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	// the static type is `any`, the registered structs are found by their dynamic types
+	m := map[string]any{
+		"circle": &Circle{Radius: 10},
+		"rect":   &Rect{Width: 5, Height: 3},
+		"shapes": []any{&Circle{Radius: 1}, "plain"},
+		"count":  2,
+		"none":   nil,
+	}
+	buf, err := poly.Marshal(m, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"circle":{"type":"circle","radius":10},
+		"rect":{"type":"rect","width":5,"height":3},
+		"shapes":[{"type":"circle","radius":1},"plain"],
+		"count":2,
+		"none":null
+	}`, string(buf))
+
+	// nothing is resolved back into `any`, json.Unmarshal decodes generic values
+	m2 := map[string]any{}
+	require.NoError(t, poly.Unmarshal(buf, &m2, true))
+	require.Equal(t, map[string]any{"type": "circle", "radius": 10.0}, m2["circle"])
+}
+
+func TestValueMapMarshal(t *testing.T) {
+	poly := newShapePoly(t)
+
+	// structs held by value in map values are stamped on copies stored back into the map
+	m := map[string]Shape{"a": Circle{Radius: 1}, "b": &Rect{Width: 2}}
+	require.NoError(t, poly.BeforeMarshalJSON(m, true))
+	require.Equal(t, map[string]Shape{"a": Circle{Type: "circle", Radius: 1}, "b": &Rect{Type: "rect", Width: 2}}, m)
+
+	type Holder struct {
+		Shape Shape `json:"shape"`
+	}
+	holders := map[int]Holder{1: {Shape: Rect{Height: 3}}}
+	buf, err := poly.Marshal(holders, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"1":{"shape":{"type":"rect","width":0,"height":3}}}`, string(buf))
+	require.Equal(t, map[int]Holder{1: {Shape: Rect{Type: "rect", Height: 3}}}, holders)
+
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Square)(nil), "square"))
+	measurables := map[string]Measurable{"s": Square{Side: 2}}
+	buf, err = poly.Marshal(measurables, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"s":{"type":"square","side":2}}`, string(buf))
+}
+
+func TestResolveAny(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", ResolveAny()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	buf := []byte(`[{"type":"circle","radius":1},"plain",2,{"type":"hexagon"},{"name":"x"},{"type":"rect","width":3}]`)
+	var items []any
+	require.NoError(t, poly.Unmarshal(buf, &items, true))
+	require.Equal(t, []any{
+		&Circle{Type: "circle", Radius: 1},
+		"plain",
+		2.0,
+		map[string]any{"type": "hexagon"},
+		map[string]any{"name": "x"},
+		&Rect{Type: "rect", Width: 3},
+	}, items)
+
+	buf = []byte(`{"a":{"type":"rect","height":4},"b":[{"type":"circle"}]}`)
+	var m map[string]any
+	require.NoError(t, poly.Unmarshal(buf, &m, true))
+	require.Equal(t, map[string]any{
+		"a": &Rect{Type: "rect", Height: 4},
+		// values nested in generic values are not resolved
+		"b": []any{map[string]any{"type": "circle"}},
+	}, m)
+
+	// without ResolveAny `any` values stay generic
+	var plain []any
+	require.NoError(t, newShapePoly(t).Unmarshal([]byte(`[{"type":"circle"}]`), &plain, true))
+	require.Equal(t, []any{map[string]any{"type": "circle"}}, plain)
+
+	err := poly.RegisterInterface((*Measurable)(nil), "type", ResolveAny())
+	require.ErrorContains(t, err, "poly: interface github.com/reyoung/poly.Shape already resolves any values")
+}
+
+func TestIntegerLikeMapKeys(t *testing.T) {
+	// path segments are read as object keys or array indexes by the value they meet,
+	// so the key "0" does not collide with index 0
+	poly := newShapePoly(t)
+	buf := []byte(`[{"0":[{"type":"rect","width":1},{"type":"circle","radius":2}],"1":[]}]`)
+	var groups []map[string][]Shape
+	require.NoError(t, poly.Unmarshal(buf, &groups, true))
+	require.Equal(t, []map[string][]Shape{{
+		"0": {&Rect{Type: "rect", Width: 1}, &Circle{Type: "circle", Radius: 2}},
+		"1": {},
+	}}, groups)
+
+	var resolveErr *ResolveError
+	buf = []byte(`[{"0":[{"type":"rect"},{"type":"square"}]}]`)
+	require.ErrorAs(t, poly.Unmarshal(buf, &groups, true), &resolveErr)
+	require.Equal(t, "0.0.1.type", resolveErr.Path)
+
+	external := &Poly{}
+	require.NoError(t, external.RegisterInterface((*Shape)(nil), "type", ExternallyTagged()))
+	require.NoError(t, external.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	buf, err := external.Marshal([]map[string][]Shape{{"0": {&Circle{Radius: 1}}, "1": nil}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"0":[{"circle":{"type":"","radius":1}}],"1":null}]`, string(buf))
+	groups = nil
+	require.NoError(t, external.Unmarshal(buf, &groups, true))
+	require.Equal(t, []map[string][]Shape{{"0": {&Circle{Radius: 1}}, "1": nil}}, groups)
+}
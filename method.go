@@ -0,0 +1,65 @@
+package poly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// DiscriminantMethod takes the discriminant of the structs from their method named name, e.g. `Kind() string`,
+// instead of a field. Marshal adds what the method returns to the encoded object as the member named
+// discriminantFieldName, which the structs must not have as a json field, and Unmarshal resolves by the value
+// of that member. RegisterStruct with a nil value registers a struct under what the method returns for its
+// zero value. The member is added by Marshal only, BeforeMarshalJSON has no field to stamp
+func DiscriminantMethod(name string) InterfaceOption {
+	return func(t *polyType) {
+		t.discriminantMethod = name
+	}
+}
+
+// checkMethod checks the options of an interface registered with DiscriminantMethod
+func (p *Poly) checkMethod(entry *polyType) error {
+	if entry.discriminantFieldName == "" || len(splitJSONPath(entry.discriminantFieldName)) != 1 {
+		return errors.New("poly: DiscriminantMethod needs a discriminantFieldName naming a single member")
+	}
+	if entry.externallyTagged || entry.discriminantQuery != "" || entry.compositeFields != nil ||
+		entry.parentLevels != 0 || entry.singleStruct {
+		return errors.New("poly: DiscriminantMethod cannot be combined with ExternallyTagged, DiscriminantQuery, " +
+			"DiscriminantFields, ParentDiscriminant or SingleStruct")
+	}
+	return nil
+}
+
+// methodDiscriminant checks that structType has the discriminant method of entry and no field in its place,
+// and returns value, or what the method returns for the zero struct when value is nil
+func (p *Poly) methodDiscriminant(entry *polyType, structType reflect.Type, value any) (any, error) {
+	method, ok := reflect.PointerTo(structType).MethodByName(entry.discriminantMethod)
+	if !ok || method.Type.NumIn() != 1 || method.Type.NumOut() != 1 {
+		return nil, fmt.Errorf("poly: struct %s has no method %s taking no arguments and returning the discriminant",
+			structType, entry.discriminantMethod)
+	}
+	if _, _, err := p.discriminantFieldIndex(entry, structType, entry.discriminantFieldName); !errors.Is(err, errDiscriminantNotFound) {
+		return nil, fmt.Errorf("poly: struct %s has a json field %s, which DiscriminantMethod adds on marshal",
+			structType, entry.discriminantFieldName)
+	}
+	if value == nil {
+		value = reflect.New(structType).Method(method.Index).Call(nil)[0].Interface()
+	}
+	return value, nil
+}
+
+// methodRewrite returns the rewrite adding the discriminant returned by the method of the struct val,
+// registered for entry, to the object encoded at path
+func (p *Poly) methodRewrite(val reflect.Value, entry *polyType, path []string) (jsonRewrite, error) {
+	value := val.Addr().MethodByName(entry.discriminantMethod).Call(nil)[0].Interface()
+	key, err := json.Marshal(entry.discriminantFieldName)
+	if err != nil {
+		return jsonRewrite{}, err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return jsonRewrite{}, fmt.Errorf("poly: cannot encode discriminant %#v of struct %s: %w", value, val.Type(), err)
+	}
+	return jsonRewrite{path: path, insert: string(key) + ":" + string(encoded)}, nil
+}
@@ -0,0 +1,93 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Vehicle is told apart by the Kind method of its implementations
+type Vehicle interface {
+	Kind() string
+}
+
+// Car is a Vehicle without a discriminant field
+type Car struct {
+	Wheels int `json:"wheels"`
+}
+
+func (c *Car) Kind() string { return "car" }
+
+// Boat is a Vehicle without a discriminant field or other fields
+type Boat struct{}
+
+func (Boat) Kind() string { return "boat" }
+
+// KindField is a Vehicle clashing with the member added for its discriminant
+type KindField struct {
+	Type string `json:"kind"`
+}
+
+func (KindField) Kind() string { return "field" }
+
+// Fleet holds Vehicles
+type Fleet struct {
+	Flagship Vehicle            `json:"flagship"`
+	Vehicles []Vehicle          `json:"vehicles"`
+	ByName   map[string]Vehicle `json:"by_name"`
+}
+
+func TestDiscriminantMethod(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Vehicle)(nil), "kind", DiscriminantMethod("Kind")))
+	require.NoError(t, poly.RegisterStruct((*Vehicle)(nil), (*Car)(nil), nil))
+	require.NoError(t, poly.RegisterStruct((*Vehicle)(nil), (*Boat)(nil), "boat"))
+	require.NoError(t, poly.Validate())
+
+	fleet := &Fleet{
+		Flagship: Boat{},
+		Vehicles: []Vehicle{&Car{Wheels: 4}, &Boat{}},
+		ByName:   map[string]Vehicle{"a": &Car{Wheels: 3}},
+	}
+	buf, err := poly.Marshal(fleet, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"flagship":{"kind":"boat"},
+		"vehicles":[{"kind":"car","wheels":4},{"kind":"boat"}],
+		"by_name":{"a":{"kind":"car","wheels":3}}
+	}`, string(buf))
+	require.Contains(t, string(buf), `[{"kind":"car","wheels":4},{"kind":"boat"}]`)
+
+	fleet2 := &Fleet{}
+	require.NoError(t, poly.Unmarshal(buf, fleet2, true))
+	require.Equal(t, &Fleet{
+		Flagship: &Boat{},
+		Vehicles: []Vehicle{&Car{Wheels: 4}, &Boat{}},
+		ByName:   map[string]Vehicle{"a": &Car{Wheels: 3}},
+	}, fleet2)
+
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"vehicles":[{"kind":"bike"}]}`), fleet2, true), &resolveErr)
+	require.Equal(t, "vehicles.0.kind", resolveErr.Path)
+}
+
+func TestDiscriminantMethodErrors(t *testing.T) {
+	poly := &Poly{}
+	err := poly.RegisterInterface((*Vehicle)(nil), "", DiscriminantMethod("Kind"))
+	require.EqualError(t, err, "poly: DiscriminantMethod needs a discriminantFieldName naming a single member")
+	err = poly.RegisterInterface((*Vehicle)(nil), "meta.kind", DiscriminantMethod("Kind"))
+	require.EqualError(t, err, "poly: DiscriminantMethod needs a discriminantFieldName naming a single member")
+	err = poly.RegisterInterface((*Vehicle)(nil), "kind", DiscriminantMethod("Kind"), ExternallyTagged())
+	require.ErrorContains(t, err, "cannot be combined")
+
+	require.NoError(t, poly.RegisterInterface((*Vehicle)(nil), "kind", DiscriminantMethod("Name")))
+	err = poly.RegisterStruct((*Vehicle)(nil), (*Car)(nil), nil)
+	require.EqualError(t, err, "poly: struct poly.Car has no method Name taking no arguments and returning the discriminant")
+
+	poly = &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Vehicle)(nil), "kind", DiscriminantMethod("Kind")))
+	require.NoError(t, poly.RegisterStruct((*Vehicle)(nil), (*Car)(nil), nil))
+	require.NoError(t, poly.RegisterStruct((*Vehicle)(nil), (*Boat)(nil), "boat"))
+	err = poly.RegisterStruct((*Vehicle)(nil), (*KindField)(nil), nil)
+	require.EqualError(t, err, "poly: struct poly.KindField has a json field kind, which DiscriminantMethod adds on marshal")
+}
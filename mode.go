@@ -0,0 +1,42 @@
+package poly
+
+// Mode controls how the pre-pass treats values it cannot type
+type Mode int
+
+const (
+	// ModeStrict fails on unregistered interfaces, on registered interfaces holding unregistered structs,
+	// and on discriminants that match no registered struct
+	ModeStrict Mode = iota
+
+	// ModeSkipUnregistered leaves unregistered interfaces to encoding/json and marshals unregistered structs
+	// without their discriminant, but still fails on unknown discriminants. It is what strict=false means
+	ModeSkipUnregistered
+
+	// ModeLenient fails on nothing: unregistered interfaces are left to encoding/json, unregistered structs
+	// are marshaled without their discriminant, and interfaces with unknown discriminants are handled
+	// as if registered with IgnoreUnknown, unless registered with RejectUnknown
+	ModeLenient
+)
+
+// modeOf returns the mode of the strict flag taken by the bool variants of the methods
+func modeOf(strict bool) Mode {
+	if strict {
+		return ModeStrict
+	}
+	return ModeSkipUnregistered
+}
+
+// SetStrict sets DefaultMode to the mode of the strict flag, ModeStrict or ModeSkipUnregistered
+func (p *Poly) SetStrict(strict bool) {
+	p.DefaultMode = modeOf(strict)
+}
+
+// skipsUnregistered reports whether interfaces and structs without a registration are left alone
+func (m Mode) skipsUnregistered() bool {
+	return m != ModeStrict
+}
+
+// skipsUnresolved reports whether registered interfaces whose type cannot be resolved are left alone
+func (m Mode) skipsUnresolved() bool {
+	return m == ModeLenient
+}
@@ -0,0 +1,162 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// ModeRequest holds a registered and an unregistered interface
+type ModeRequest struct {
+	Shapes []Measurable          `json:"shapes"`
+	ByName map[string]Measurable `json:"by_name"`
+	Other  Unregistered          `json:"other"`
+}
+
+// Unregistered is an interface never registered with Poly
+type Unregistered interface{}
+
+func TestModeStrict(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+
+	_, err := poly.MarshalMode(&ModeRequest{Other: 1}, ModeStrict)
+	require.ErrorContains(t, err, "poly: interface type github.com/reyoung/poly.Unregistered not registered")
+	_, err = poly.MarshalMode(&ModeRequest{Shapes: []Measurable{&Square{}}}, ModeStrict)
+	require.ErrorContains(t, err, "not found in struct")
+
+	err = poly.UnmarshalMode([]byte(`{"other":{}}`), &ModeRequest{}, ModeStrict)
+	require.ErrorContains(t, err, "poly: interface type github.com/reyoung/poly.Unregistered not registered")
+	err = poly.UnmarshalMode([]byte(`{"shapes":[{"type":"square"}]}`), &ModeRequest{}, ModeStrict)
+	require.ErrorContains(t, err, "poly: cannot resolve interface")
+}
+
+func TestModeSkipUnregistered(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+
+	buf, err := poly.MarshalMode(&ModeRequest{Other: 1}, ModeSkipUnregistered)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":null,"by_name":null,"other":1}`, string(buf))
+	// unregistered structs are marshaled without a discriminant
+	buf, err = poly.MarshalMode(&ModeRequest{Shapes: []Measurable{&Square{Side: 2}}}, ModeSkipUnregistered)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"type":"","side":2}],"by_name":null,"other":null}`, string(buf))
+
+	req := &ModeRequest{}
+	require.NoError(t, poly.UnmarshalMode([]byte(`{"other":{"a":1}}`), req, ModeSkipUnregistered))
+	require.Equal(t, map[string]any{"a": 1.0}, req.Other)
+	err = poly.UnmarshalMode([]byte(`{"shapes":[{"type":"square"}]}`), &ModeRequest{}, ModeSkipUnregistered)
+	require.ErrorContains(t, err, "poly: cannot resolve interface")
+
+	// strict=false is ModeSkipUnregistered
+	err = poly.Unmarshal([]byte(`{"shapes":[{"type":"square"}]}`), &ModeRequest{}, false)
+	require.ErrorContains(t, err, "poly: cannot resolve interface")
+}
+
+func TestModeLenient(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+
+	// unregistered structs are marshaled without a discriminant
+	buf, err := poly.MarshalMode(&ModeRequest{Shapes: []Measurable{&Square{Side: 2}, &Disk{Radius: 1}}, Other: 1}, ModeLenient)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"shapes":[{"type":"","side":2},{"type":"disk","radius":1}],
+		"by_name":null,
+		"other":1
+	}`, string(buf))
+
+	// unknown discriminants are left nil
+	buf = []byte(`{
+		"shapes":[{"type":"square","side":2},{"type":"disk","radius":1}],
+		"by_name":{"a":{"type":"square"},"b":{"type":"disk","radius":2}},
+		"other":{"a":1}
+	}`)
+	req := &ModeRequest{}
+	require.NoError(t, poly.UnmarshalMode(buf, req, ModeLenient))
+	require.Equal(t, []Measurable{nil, &Disk{Type: "disk", Radius: 1}}, req.Shapes)
+	require.Equal(t, map[string]Measurable{"a": nil, "b": &Disk{Type: "disk", Radius: 2}}, req.ByName)
+	require.Equal(t, map[string]any{"a": 1.0}, req.Other)
+}
+
+func TestIgnoreUnknown(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", IgnoreUnknown()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	// unknown elements become nil even in strict mode
+	buf := []byte(`{"shapes":[{"type":"circle","radius":1},{"type":"hexagon","side":2}]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle", Radius: 1}, nil}, req.Shapes)
+
+	// the struct registered for an absent discriminant is the fallback
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), ""))
+	req = &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle", Radius: 1}, &Rect{Type: "hexagon"}}, req.Shapes)
+}
+
+func TestDefaultMode(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+
+	// the zero value is strict
+	_, err := poly.MarshalDefault(&ModeRequest{Other: 1})
+	require.ErrorContains(t, err, "poly: interface type github.com/reyoung/poly.Unregistered not registered")
+	require.ErrorContains(t, poly.BeforeMarshalJSONDefault(&ModeRequest{Other: 1}), "not registered")
+
+	poly.SetStrict(false)
+	require.Equal(t, ModeSkipUnregistered, poly.DefaultMode)
+	buf, err := poly.MarshalDefault(&ModeRequest{Other: 1})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":null,"by_name":null,"other":1}`, string(buf))
+	req := &ModeRequest{}
+	require.NoError(t, poly.UnmarshalDefault([]byte(`{"other":{"a":1}}`), req))
+	require.Equal(t, map[string]any{"a": 1.0}, req.Other)
+	require.NoError(t, poly.BeforeUnmarshalJSONDefault([]byte(`{"other":{}}`), &ModeRequest{}))
+
+	// the explicit variants override it per call
+	_, err = poly.Marshal(&ModeRequest{Other: 1}, true)
+	require.ErrorContains(t, err, "not registered")
+
+	poly.DefaultMode = ModeLenient
+	req = &ModeRequest{}
+	require.NoError(t, poly.UnmarshalDefault([]byte(`{"shapes":[{"type":"square"}]}`), req))
+	require.Equal(t, []Measurable{nil}, req.Shapes)
+	err = poly.Unmarshal([]byte(`{"shapes":[{"type":"square"}]}`), &ModeRequest{}, false)
+	require.ErrorContains(t, err, "poly: cannot resolve interface")
+}
+
+func TestRejectUnknown(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type", RejectUnknown()))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	var req struct {
+		Shapes []Measurable `json:"shapes"`
+		Shape  Shape        `json:"shape"`
+		Other  Unregistered `json:"other"`
+	}
+	// the lenient mode still forgives the other interfaces
+	buf := []byte(`{"shapes":[{"type":"disk","radius":1}],"shape":{"type":"oval"},"other":{"a":1}}`)
+	require.NoError(t, poly.UnmarshalMode(buf, &req, ModeLenient))
+	require.Equal(t, []Measurable{&Disk{Type: "disk", Radius: 1}}, req.Shapes)
+	require.Nil(t, req.Shape)
+
+	var resolveErr *ResolveError
+	buf = []byte(`{"shapes":[{"type":"disk"},{"type":"square"}],"shape":{"type":"oval"}}`)
+	require.ErrorAs(t, poly.UnmarshalMode(buf, &req, ModeLenient), &resolveErr)
+	require.Equal(t, "shapes.1.type", resolveErr.Path)
+	require.Equal(t, "square", resolveErr.Value)
+
+	err := (&Poly{}).RegisterInterface((*Shape)(nil), "type", RejectUnknown(), IgnoreUnknown())
+	require.EqualError(t, err, "poly: IgnoreUnknown and RejectUnknown cannot be combined")
+}
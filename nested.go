@@ -0,0 +1,109 @@
+package poly
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// isNested reports whether the struct field f is tagged `poly:"nested"`: an interface field whose value is
+// a JSON document of its own, carried as a string on the wire (e.g. `"shape":"{\"type\":\"circle\"}"`).
+// Marshal stamps the value and encodes it into the string, Unmarshal resolves and decodes the document
+// the string holds, or the value itself when it is not a string. The pre-passes alone cannot change the
+// encoding, so BeforeMarshalJSON and BeforeUnmarshalJSON leave such fields to the caller
+func (p *Poly) isNested(f reflect.StructField) bool {
+	for _, option := range strings.Split(f.Tag.Get("poly"), ",") {
+		if option == "nested" {
+			return true
+		}
+	}
+	return false
+}
+
+// beforeMarshalNested prepares val, the nested field at the path of state, for marshaling. The value is walked
+// as a document of its own, and encoded into the string replacing it once the stamps are applied
+func (p *Poly) beforeMarshalNested(state *marshalState, val reflect.Value, depth int) error {
+	if val.Kind() != reflect.Interface {
+		return fmt.Errorf("poly: nested field at field path %s must be an interface, got %s",
+			joinJSONPath(state.path), val.Type())
+	}
+	if val.IsNil() {
+		return nil
+	}
+	target := val
+	if !target.CanAddr() {
+		target = reflect.New(val.Type()).Elem()
+		target.Set(val)
+	}
+	nested := &marshalState{
+		traversal: traversal{ctx: state.ctx},
+		mode:      state.mode,
+		walking:   state.walking,
+		restoring: state.restoring,
+	}
+	if err := p.beforeMarshalJSONValue(nested, target, depth); err != nil {
+		return fmt.Errorf("%w in the nested document at field path %s", err, joinJSONPath(state.path))
+	}
+	index := len(state.rewrites)
+	state.rewrites = append(state.rewrites, jsonRewrite{path: state.pathCopy()})
+	state.stamps = append(state.stamps, func() error {
+		for _, stamp := range nested.stamps {
+			if err := stamp(); err != nil {
+				return err
+			}
+		}
+		state.restores = append(state.restores, nested.restores...)
+		buf, err := p.codec().Marshal(target.Addr().Interface())
+		if err != nil {
+			return err
+		}
+		if buf, err = p.rewrite(buf, nested.rewrites); err != nil {
+			return err
+		}
+		text, err := json.Marshal(string(buf))
+		if err != nil {
+			return err
+		}
+		state.rewrites[index].replace = string(text)
+		return nil
+	})
+	return nil
+}
+
+// beforeUnmarshalNested prepares val, the nested field named fieldName of the object parent, for unmarshaling.
+// When it holds a string, the document in it is resolved, and decoded into val after json.Unmarshal left it
+// nil, before the fixups of the document run
+func (p *Poly) beforeUnmarshalNested(state *unmarshalState, val reflect.Value, fieldName string, parent jsonNode, depth int) error {
+	state.descend(fieldName, parent)
+	defer state.ascend()
+	if val.Kind() != reflect.Interface {
+		return fmt.Errorf("poly: nested field at field path %s must be an interface, got %s",
+			joinJSONPath(state.path), val.Type())
+	}
+	node := p.member(parent, fieldName)
+	text, ok := node.Str()
+	if !ok {
+		return p.beforeUnmarshalJSONValue(state, val, node, depth)
+	}
+	doc, err := p.parseJSON([]byte(text))
+	if err != nil {
+		return fmt.Errorf("%w in the nested document at field path %s", err, joinJSONPath(state.path))
+	}
+	resolved := reflect.New(val.Type()).Elem()
+	later := state.decodeLater(state.path)
+	state.fixups = append(state.fixups, func() error {
+		val.Set(resolved)
+		if resolved.IsNil() {
+			return nil
+		}
+		return p.decode([]byte(text), val.Addr().Interface(), later.inner())
+	})
+	if err := p.beforeUnmarshalJSONValue(state, val, doc, depth); err != nil {
+		return err
+	}
+	// json.Unmarshal cannot decode the string into the resolved struct, it is stored back by the fixup
+	resolved.Set(val)
+	val.Set(reflect.Zero(val.Type()))
+	return nil
+}
@@ -0,0 +1,79 @@
+package poly
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NestedDocument carries shapes as JSON documents inside strings
+type NestedDocument struct {
+	Name   string  `json:"name"`
+	Shape  Shape   `json:"shape" poly:"nested"`
+	Shapes []Shape `json:"shapes"`
+	Other  Shape   `json:"other,omitempty" poly:"nested"`
+}
+
+func TestNestedField(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+
+	doc := &NestedDocument{
+		Name:   "doc",
+		Shape:  &Group{Shapes: []Shape{&Circle{Radius: 1}}},
+		Shapes: []Shape{&Rect{Width: 2}},
+	}
+	buf, err := poly.Marshal(doc, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"doc","shape":"{\"type\":\"group\",\"shapes\":[{\"type\":\"circle\",\"radius\":1}]}",
+		"shapes":[{"type":"rect","width":2,"height":0}]}`, string(buf))
+
+	decoded := &NestedDocument{}
+	require.NoError(t, poly.Unmarshal(buf, decoded, true))
+	require.Equal(t, &NestedDocument{
+		Name:   "doc",
+		Shape:  &Group{Type: "group", Shapes: []Shape{&Circle{Type: "circle", Radius: 1}}},
+		Shapes: []Shape{&Rect{Type: "rect", Width: 2}},
+	}, decoded)
+
+	// the document may be written as it is too
+	decoded = &NestedDocument{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"circle","radius":3},"other":"{\"type\":\"rect\"}"}`), decoded, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 3}, decoded.Shape)
+	require.Equal(t, &Rect{Type: "rect"}, decoded.Other)
+
+	var resolveErr *ResolveError
+	err = poly.Unmarshal([]byte(`{"shape":"{\"type\":\"oval\"}"}`), &NestedDocument{}, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Contains(t, err.Error(), "by field path shape.type")
+	require.Error(t, poly.Unmarshal([]byte(`{"shape":"{\"type\":"}`), &NestedDocument{}, true))
+
+	// under ModeLenient an unknown nested document leaves the field nil
+	decoded = &NestedDocument{}
+	require.NoError(t, poly.UnmarshalMode([]byte(`{"shape":"{\"type\":\"oval\"}"}`), decoded, ModeLenient))
+	require.Nil(t, decoded.Shape)
+
+	var invalid struct {
+		Shape string `json:"shape" poly:"nested"`
+	}
+	_, err = poly.Marshal(&invalid, true)
+	require.ErrorContains(t, err, "poly: nested field at field path shape must be an interface, got string")
+	require.ErrorContains(t, poly.Unmarshal([]byte(`{"shape":"{}"}`), &invalid, true),
+		"poly: nested field at field path shape must be an interface, got string")
+
+	// the caller decodes after BeforeUnmarshalJSON, it is not told about the string
+	var measurable struct {
+		Shape Measurable `json:"shape" poly:"nested"`
+	}
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+	buf = []byte(`{"shape":"{\"type\":\"disk\",\"radius\":2}"}`)
+	require.NoError(t, poly.Unmarshal(buf, &measurable, true))
+	require.Equal(t, &Disk{Type: "disk", Radius: 2}, measurable.Shape)
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, &measurable, true))
+	require.Error(t, json.Unmarshal(buf, &measurable))
+}
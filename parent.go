@@ -0,0 +1,69 @@
+package poly
+
+import (
+	"errors"
+	"strings"
+)
+
+// ParentDiscriminant locates the discriminant on unmarshal at path relative to a node enclosing the variant
+// object rather than inside it, for envelopes carrying the type beside the payload, e.g.
+// `{"meta":{"type":"circle"},"payload":{"radius":10}}`. Every leading `../` climbs one level up from the
+// variant object, so `../meta.type` reads the meta member next to the interface field. discriminantFieldName
+// still names the field stamped on marshal, or is empty when the structs carry no discriminant field and are
+// marshaled as they are, leaving the envelope to the caller
+func ParentDiscriminant(path string) InterfaceOption {
+	return func(t *polyType) {
+		for strings.HasPrefix(path, "../") {
+			path = path[len("../"):]
+			t.parentLevels++
+		}
+		t.parentPath = path
+	}
+}
+
+// checkParent checks the options of an interface registered with ParentDiscriminant
+func (p *Poly) checkParent(entry *polyType) error {
+	if entry.parentLevels == 0 || entry.parentPath == "" {
+		return errors.New("poly: ParentDiscriminant needs a path starting with ../, e.g. ../meta.type")
+	}
+	if entry.externallyTagged || entry.discriminantQuery != "" || entry.compositeFields != nil || entry.resolveAny {
+		return errors.New("poly: ParentDiscriminant cannot be combined with ExternallyTagged, DiscriminantQuery, DiscriminantFields or ResolveAny")
+	}
+	return nil
+}
+
+// descend pushes segment to the path together with parent, the node holding the value visited next
+func (s *unmarshalState) descend(segment string, parent jsonNode) {
+	s.push(segment)
+	s.parents = append(s.parents, parent)
+}
+
+// ascend undoes descend when returning from a child value
+func (s *unmarshalState) ascend() {
+	s.pop()
+	s.parents = s.parents[:len(s.parents)-1]
+}
+
+// discriminantNode returns the node the discriminant of entry is read from for the variant object node:
+// node itself, or the enclosing node ParentDiscriminant climbs to, absent above the document root
+func (p *Poly) discriminantNode(state *unmarshalState, entry *polyType, node jsonNode) jsonNode {
+	if entry.parentLevels == 0 {
+		return node
+	}
+	if entry.parentLevels > len(state.parents) {
+		return jsonNode{}
+	}
+	return state.parents[len(state.parents)-entry.parentLevels]
+}
+
+// discriminantPath returns the field path of the discriminant of entry for messages,
+// given the field path of the variant object
+func (p *Poly) discriminantPath(state *unmarshalState, entry *polyType) string {
+	path := state.path
+	if entry.parentLevels > len(path) {
+		path = nil
+	} else {
+		path = path[:len(path)-entry.parentLevels]
+	}
+	return p.fieldPath(path, p.discriminantLocator(entry))
+}
@@ -0,0 +1,111 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Envelope carries the type of its payload in a metadata object beside it
+type Envelope struct {
+	Meta    EnvelopeMeta `json:"meta"`
+	Payload Shape        `json:"payload"`
+}
+
+// EnvelopeMeta is the metadata of an Envelope
+type EnvelopeMeta struct {
+	Type string `json:"type"`
+}
+
+// Batch carries the type shared by all of its items
+type Batch struct {
+	Type  string  `json:"type"`
+	Items []Shape `json:"items"`
+}
+
+// BareCircle is a circle without a discriminant field of its own
+type BareCircle struct {
+	Radius float64 `json:"radius"`
+}
+
+// BareRect is a rectangle without a discriminant field of its own
+type BareRect struct {
+	Width float64 `json:"width"`
+}
+
+func TestParentDiscriminant(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "", ParentDiscriminant("../meta.type")))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BareCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BareRect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+
+	envelope := &Envelope{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"payload":{"radius":10},"meta":{"type":"circle"}}`), envelope, true))
+	require.Equal(t, &Envelope{Meta: EnvelopeMeta{Type: "circle"}, Payload: &BareCircle{Radius: 10}}, envelope)
+
+	// the structs are marshaled as they are
+	buf, err := poly.Marshal(envelope, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"meta":{"type":"circle"},"payload":{"radius":10}}`, string(buf))
+
+	var envelopes []Envelope
+	buf = []byte(`[{"meta":{"type":"rect"},"payload":{"width":2}},{"meta":{"type":"circle"},"payload":{"radius":1}}]`)
+	require.NoError(t, poly.Unmarshal(buf, &envelopes, true))
+	require.Equal(t, []Envelope{
+		{Meta: EnvelopeMeta{Type: "rect"}, Payload: &BareRect{Width: 2}},
+		{Meta: EnvelopeMeta{Type: "circle"}, Payload: &BareCircle{Radius: 1}},
+	}, envelopes)
+
+	byName := map[string]Envelope{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"a":{"meta":{"type":"rect"},"payload":{"width":3}}}`), &byName, true))
+	require.Equal(t, &BareRect{Width: 3}, byName["a"].Payload)
+
+	var resolveErr *ResolveError
+	err = poly.Unmarshal([]byte(`[{"meta":{"type":"square"},"payload":{}}]`), &envelopes, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "0.meta.type", resolveErr.Path)
+	require.Equal(t, "square", resolveErr.Value)
+
+	// a null payload is left nil whatever its type
+	envelope = &Envelope{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"meta":{"type":"circle"},"payload":null}`), envelope, true))
+	require.Nil(t, envelope.Payload)
+
+	_, _, err = poly.ResolveType((*Shape)(nil), []byte(`{"radius":1}`))
+	require.ErrorContains(t, err, "reads its discriminant outside the document")
+}
+
+func TestParentDiscriminantLevels(t *testing.T) {
+	// the items climb over the array to the batch object
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "", ParentDiscriminant("../../type")))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BareCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BareRect)(nil), "rect"))
+	batch := &Batch{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"type":"rect","items":[{"width":1},{"width":2}]}`), batch, true))
+	require.Equal(t, &Batch{Type: "rect", Items: []Shape{&BareRect{Width: 1}, &BareRect{Width: 2}}}, batch)
+
+	// climbing above the document root finds no discriminant
+	var shape Shape
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"width":1}`), &shape, true), &resolveErr)
+	require.Equal(t, "type", resolveErr.Path)
+}
+
+func TestParentDiscriminantErrors(t *testing.T) {
+	poly := &Poly{}
+	err := poly.RegisterInterface((*Shape)(nil), "", ParentDiscriminant("meta.type"))
+	require.ErrorContains(t, err, "poly: ParentDiscriminant needs a path starting with ../")
+	err = poly.RegisterInterface((*Shape)(nil), "", ParentDiscriminant("../"))
+	require.ErrorContains(t, err, "poly: ParentDiscriminant needs a path starting with ../")
+	err = poly.RegisterInterface((*Shape)(nil), "", ParentDiscriminant("../type"), ExternallyTagged())
+	require.ErrorContains(t, err, "cannot be combined")
+
+	// a named discriminant field is still stamped on marshal
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", ParentDiscriminant("../meta.type")))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	buf, err := poly.Marshal(&Envelope{Payload: &Circle{Radius: 1}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"meta":{"type":""},"payload":{"type":"circle","radius":1}}`, string(buf))
+}
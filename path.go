@@ -0,0 +1,36 @@
+package poly
+
+import "strings"
+
+// splitJSONPath splits a dotted JSON field path into its segments, unescaping `\`-escaped characters
+// so that segments can contain dots
+func splitJSONPath(path string) []string {
+	var segments []string
+	var segment strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			segment.WriteByte(path[i])
+		case c == '.':
+			segments = append(segments, segment.String())
+			segment.Reset()
+		default:
+			segment.WriteByte(c)
+		}
+	}
+	return append(segments, segment.String())
+}
+
+// joinJSONPath joins segments into a dotted JSON field path, escaping the characters gjson
+// would otherwise read as separators or wildcards
+func joinJSONPath(segments []string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = jsonPathEscaper.Replace(segment)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// jsonPathEscaper escapes path separators and wildcards in a segment
+var jsonPathEscaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`, `*`, `\*`, `?`, `\?`)
@@ -4,13 +4,26 @@
 package poly
 
 import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+)
 
-	"github.com/tidwall/gjson"
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	jsonNumberType      = reflect.TypeOf(json.Number(""))
+	bigIntType          = reflect.TypeOf(big.Int{})
 )
 
 // polyType holds registration information for a specific interface type
@@ -18,6 +31,9 @@ type polyType struct {
 	// fieldType is the reflect.Type of the interface
 	fieldType reflect.Type
 
+	// order is the number of interfaces registered before this one, ordering interfaces of the same name
+	order int
+
 	// discriminantFieldName is the JSON field name used to distinguish implementations
 	discriminantFieldName string
 
@@ -30,41 +46,453 @@ type polyType struct {
 	// structTypes are the reflect.Types of the registered structs
 	structTypes []reflect.Type
 
-	// structFieldPos tracks the position of the discriminant field in each struct
-	structFieldPos []int
+	// structMatchers are the predicates of the structs registered with RegisterStructMatch,
+	// nil for the structs matched by their discriminant value
+	structMatchers []func(any) bool
+
+	// hasMatchers reports whether structMatchers holds a predicate
+	hasMatchers bool
+
+	// structIDs number the registrations of the structs, telling apart those of the same struct
+	// and value, so Handle.Unregister removes its own
+	structIDs []uint64
+
+	// structFieldPos tracks the index path of the discriminant field in each struct
+	structFieldPos [][]int
+
+	// discriminantKind is the Go kind shared by the discriminant fields of all registered structs
+	discriminantKind reflect.Kind
+
+	// omitDiscriminant clears the discriminant field on marshal instead of stamping it
+	omitDiscriminant bool
+
+	// stampOnUnmarshal sets the discriminant field of the resolved struct on unmarshal
+	stampOnUnmarshal bool
+
+	// ignoreUnknown leaves interfaces with unknown discriminants to the default struct or nil on unmarshal
+	ignoreUnknown bool
+
+	// numericStrings matches JSON strings holding numbers against numeric discriminants on unmarshal
+	numericStrings bool
+
+	// rejectUnknown fails on unknown discriminants on unmarshal even under ModeLenient
+	rejectUnknown bool
+
+	// discriminantFirst moves the discriminant to the front of the marshaled object
+	discriminantFirst bool
+
+	// externallyTagged nests each struct under its discriminant value as the only key of an object
+	// instead of reading a discriminant field inside the struct
+	externallyTagged bool
+
+	// tupleTagged pairs the discriminant value and the struct in a two-element array instead of a wrapping
+	// object, externallyTagged is set along with it
+	tupleTagged bool
+
+	// preserveDiscriminant keeps a discriminant already set in the struct on marshal instead of stamping it
+	preserveDiscriminant bool
+
+	// checkDiscriminant fails marshaling a struct whose discriminant is set to another value than its registered one
+	checkDiscriminant bool
+
+	// discriminantQuery is the gjson path expression locating the discriminant on unmarshal,
+	// instead of discriminantFieldName
+	discriminantQuery string
+
+	// parentLevels is the number of levels ParentDiscriminant climbs above the variant object,
+	// and parentPath the path of the discriminant below the node reached
+	parentLevels int
+	parentPath   string
+
+	// singleStruct resolves every object to the only registered struct, which has no discriminant field
+	singleStruct bool
+
+	// normalize maps discriminants to the form they are compared in, see NormalizeDiscriminant
+	normalize func(any) any
+
+	// discriminantMethod is the name of the method returning the discriminant of the structs,
+	// which have no discriminant field, see DiscriminantMethod
+	discriminantMethod string
+
+	// untaggedDiscriminant matches discriminant fields without a json tag by their Go name
+	untaggedDiscriminant bool
+
+	// resolveAny resolves `any` values against the interface on unmarshal
+	resolveAny bool
+
+	// defaultStruct is the struct pointer type nominated by DefaultStruct for an absent discriminant
+	defaultStruct reflect.Type
+
+	// fallbackStruct is the struct type registered with RegisterStructFallback, resolved when no other matches
+	fallbackStruct reflect.Type
+
+	// presence are the rules selecting the structs registered with RegisterStructPresence
+	presence []presenceRule
+
+	// requireDiscriminant fails unmarshaling objects without a discriminant
+	requireDiscriminant bool
+
+	// compositeFields are the field paths of a discriminant made of several fields, see DiscriminantFields
+	compositeFields []string
+
+	// structCompositePos tracks the index paths of the composite discriminant fields in each struct
+	structCompositePos [][][]int
+}
+
+// InterfaceOption customizes how a registered interface is handled
+type InterfaceOption func(*polyType)
+
+// OmitDiscriminant clears the discriminant field on marshal instead of stamping it, so a field
+// tagged with omitempty is left out of the output. The discriminant is still used on unmarshal,
+// which suits payloads where the type is already carried elsewhere
+func OmitDiscriminant() InterfaceOption {
+	return func(t *polyType) {
+		t.omitDiscriminant = true
+	}
 }
 
+// DefaultMaxDepth is the recursion limit of the pre-pass when Poly.MaxDepth is not set
+const DefaultMaxDepth = 10000
+
 // Poly manages the registration of interfaces and their implementations for polymorphic JSON handling
 type Poly struct {
-	types map[string]*polyType
+	// MaxDepth limits how deep the pre-pass recurses into a value, so that deeply nested documents
+	// fail with an error instead of overflowing the stack. Zero means DefaultMaxDepth
+	MaxDepth int
+
+	// MaxSliceLen limits the number of elements of a JSON array the unmarshal pre-pass allocates a slice for,
+	// failing with an error above it. Slices are allocated for the elements actually present. Zero means no limit
+	MaxSliceLen int
+
+	// Codec encodes and decodes documents in Marshal and Unmarshal. Nil means encoding/json
+	Codec Codec
+
+	// OnResolve, if set, is called by the unmarshal pre-pass for every interface it resolves, with the
+	// field path of the interface, its type, the type of the value chosen for it and the discriminant value
+	OnResolve func(path string, iface reflect.Type, chosen reflect.Type, value any)
+
+	// ReuseValues makes the unmarshal pre-pass keep the struct pointer an interface already holds when it
+	// points to the struct resolved for it, instead of creating a new one, so pooled values are decoded into.
+	// Like encoding/json decoding into a pointer, fields absent in the JSON keep their values
+	ReuseValues bool
+
+	// KeyFunc, if set, names interface types in messages, errors and Stats instead of their package path
+	// and name, e.g. to tell unnamed interfaces apart. Interfaces are registered by type identity either way,
+	// and unnamed interfaces can only be registered with KeyFunc set, since they have no name of their own
+	KeyFunc func(reflect.Type) string
+
+	// DefaultMode is the mode of the variants taking no strict flag, such as MarshalDefault and UnmarshalDefault,
+	// so a codebase settles it once. The zero value is ModeStrict
+	DefaultMode Mode
+
+	// CollectErrors makes the unmarshal pre-pass carry on past the interfaces it cannot resolve, leaving them nil,
+	// and report all of them joined with errors.Join instead of stopping at the first one
+	CollectErrors bool
+
+	// ClearDiscriminantAfterMarshal makes Marshal and its variants put the values they stamp back the way they
+	// were once encoded, so discriminant fields left empty by the caller stay empty. BeforeMarshalJSON, whose
+	// caller does the encoding, still leaves them stamped
+	ClearDiscriminantAfterMarshal bool
+
+	types map[reflect.Type]*polyType
+
+	// structEntries maps each registered struct type to the interface it was first registered for,
+	// to stamp structs held by `any` values
+	structEntries map[reflect.Type]*polyType
+
+	// anyInterface is the interface registered with ResolveAny, if any
+	anyInterface *polyType
+
+	// wireNames maps the struct types registered with RegisterWireNames to the wire names of their fields
+	wireNames map[reflect.Type]map[string]string
+
+	// registrations counts the struct registrations, numbering them in structIDs
+	registrations uint64
+}
+
+// StampOnUnmarshal sets the discriminant field of the resolved struct to its registered value on unmarshal,
+// so the decoded object describes its type even when the JSON omits the discriminant and the struct
+// was chosen as the default. A discriminant present in the JSON is still decoded over it
+func StampOnUnmarshal() InterfaceOption {
+	return func(t *polyType) {
+		t.stampOnUnmarshal = true
+	}
+}
+
+// IgnoreUnknown makes Unmarshal resolve an unknown discriminant to the struct used for an absent one,
+// see DefaultStruct, or leave the interface nil when there is none, instead of failing. It suits
+// clients that should drop variants added after them, whatever the mode; ModeLenient does the same for
+// every interface
+func IgnoreUnknown() InterfaceOption {
+	return func(t *polyType) {
+		t.ignoreUnknown = true
+	}
+}
+
+// RejectUnknown makes Unmarshal fail on discriminants of the interface that match no registered struct
+// whatever the mode, so a ModeLenient decoding forgiving other interfaces still rejects unknown variants
+// of this one. It cannot be combined with IgnoreUnknown
+func RejectUnknown() InterfaceOption {
+	return func(t *polyType) {
+		t.rejectUnknown = true
+	}
+}
+
+// NumericStrings makes Unmarshal match a discriminant sent as a string holding a JSON number, e.g. `"1"`,
+// against numeric registered values as if it was the number, for producers that quote every value.
+// Strings still match string discriminants first. Declaring the discriminant field with the `,string`
+// json tag option lets encoding/json decode the quoted number into it and quote it on marshal too
+func NumericStrings() InterfaceOption {
+	return func(t *polyType) {
+		t.numericStrings = true
+	}
+}
+
+// DiscriminantFirst moves the discriminant to the front of the object on marshal, wherever its field
+// is declared in the struct, to match schemas expecting the type first. For a dotted discriminant path
+// the outermost member is moved. Reordering happens in Marshal only
+func DiscriminantFirst() InterfaceOption {
+	return func(t *polyType) {
+		t.discriminantFirst = true
+	}
+}
+
+// ExternallyTagged nests every registered struct under its discriminant value as the only key of a
+// wrapping object, e.g. `{"circle":{"radius":10}}`, the way serde tags enums externally by default.
+// The structs need no discriminant field, so discriminantFieldName is ignored and the discriminant
+// values must be strings. Wrapping happens in Marshal and unwrapping in Unmarshal only
+func ExternallyTagged() InterfaceOption {
+	return func(t *polyType) {
+		t.externallyTagged = true
+	}
+}
+
+// TupleTagged pairs every registered struct with its discriminant value in a two-element array,
+// e.g. `["circle",{"radius":10}]`. It is ExternallyTagged with the array in place of the wrapping object,
+// so the same rules and restrictions apply
+func TupleTagged() InterfaceOption {
+	return func(t *polyType) {
+		t.externallyTagged = true
+		t.tupleTagged = true
+	}
+}
+
+// PreserveExistingDiscriminant keeps a discriminant the struct already carries on marshal, even when it
+// differs from the registered value, instead of overwriting it. Zero discriminants are still stamped
+func PreserveExistingDiscriminant() InterfaceOption {
+	return func(t *polyType) {
+		t.preserveDiscriminant = true
+	}
+}
+
+// ErrorOnDiscriminantMismatch fails marshaling a struct that already carries a discriminant other than
+// its registered value, to catch structs registered under the wrong value. Zero discriminants are stamped.
+// It takes precedence over PreserveExistingDiscriminant
+func ErrorOnDiscriminantMismatch() InterfaceOption {
+	return func(t *polyType) {
+		t.checkDiscriminant = true
+	}
+}
+
+// DiscriminantQuery locates the discriminant on unmarshal by the gjson path expression query, evaluated
+// against the variant object, for discriminants a dotted field path cannot reach, e.g.
+// `attrs.#(key=="kind").value`. Member paths, array indexes, `*` and `?` wildcards, `#(...)` queries
+// and `@` modifiers are supported; the expression must select a single value, as `#(...)#` queries and
+// multipaths select arrays. discriminantFieldName still names the field stamped on marshal, or is empty
+// when the structs carry no discriminant field of their own and are marshaled as they are.
+// Queries need gjson, so RegisterInterface rejects them in builds with the polystdjson tag
+func DiscriminantQuery(query string) InterfaceOption {
+	return func(t *polyType) {
+		t.discriminantQuery = query
+	}
+}
+
+// SingleStruct registers an interface with exactly one implementation, whose type is implied by where the
+// interface appears rather than carried in the JSON. The struct needs no discriminant field, so pass an empty
+// discriminantFieldName, and Unmarshal resolves every object to it. The value passed to RegisterStruct only
+// names the struct, e.g. to OnResolve
+func SingleStruct() InterfaceOption {
+	return func(t *polyType) {
+		t.singleStruct = true
+	}
+}
+
+// UntaggedDiscriminant lets the discriminant field path match struct fields without a json tag by their
+// Go name, which encoding/json also writes them under, when no tagged field matches, e.g. "Kind" for a field
+// `Kind string`. The JSON is looked up with the Go name as it is, while encoding/json also decodes keys
+// differing in case into the field
+func UntaggedDiscriminant() InterfaceOption {
+	return func(t *polyType) {
+		t.untaggedDiscriminant = true
+	}
+}
+
+// NormalizeDiscriminant compares discriminants on unmarshal after mapping both the value read from JSON and
+// the registered values with normalize, e.g. trimming and lowercasing strings so that `" Circle "` resolves
+// to the struct registered as "circle". The predicates of RegisterStructMatch get the normalized value.
+// It does not apply to ExternallyTagged or DiscriminantFields interfaces
+func NormalizeDiscriminant(normalize func(any) any) InterfaceOption {
+	return func(t *polyType) {
+		t.normalize = normalize
+	}
+}
+
+// DefaultStruct nominates the struct Unmarshal resolves an object without a discriminant to, e.g.
+// DefaultStruct((*Circle)(nil)); it must be registered for the interface. Without it and without
+// RequireDiscriminant such objects resolve to the struct registered with the zero discriminant value,
+// such as "", if there is one
+func DefaultStruct(structPtr any) InterfaceOption {
+	return func(t *polyType) {
+		t.defaultStruct = reflect.TypeOf(structPtr)
+	}
+}
+
+// RequireDiscriminant makes Unmarshal fail on objects without a discriminant instead of resolving them
+// to the struct registered with the zero discriminant value
+func RequireDiscriminant() InterfaceOption {
+	return func(t *polyType) {
+		t.requireDiscriminant = true
+	}
+}
+
+// ResolveAny makes Unmarshal resolve values of static type `any`, such as the elements of `[]any` or
+// `map[string]any`, against the interface when their JSON object carries the discriminant of one of its
+// registered structs, or their array pairs it with the struct for TupleTagged. Other values still decode
+// to generic values, and so do the values nested in them.
+// At most one interface of a Poly can resolve `any` values
+func ResolveAny() InterfaceOption {
+	return func(t *polyType) {
+		t.resolveAny = true
+	}
 }
 
 // RegisterInterface registers an interface type for polymorphic handling
 // iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
-// discriminantFieldName: the JSON field name used to distinguish implementations (e.g., "type")
-// discriminantFieldParser: a function to parse the discriminant field value from raw JSON
+// discriminantFieldName: the JSON field name used to distinguish implementations (e.g., "type"),
+// or a dotted path when the discriminant is nested inside the variant object (e.g., "meta.kind").
+// Dots in field names are escaped with a backslash (e.g., `meta\.kind` for a field named "meta.kind").
+// It may only be empty with ExternallyTagged, DiscriminantFields, DiscriminantQuery, ParentDiscriminant
+// or SingleStruct, which locate the discriminant otherwise
+// opts: options customizing how the interface is handled
 func (p *Poly) RegisterInterface(
 	iFacePtr any,
-	discriminantFieldName string) error {
+	discriminantFieldName string,
+	opts ...InterfaceOption) error {
 	iFaceType, err := p.iFaceType(iFacePtr)
 	if err != nil {
 		return err
 	}
-	key := iFaceType.PkgPath() + "." + iFaceType.Name()
+	return p.RegisterInterfaceType(iFaceType, discriminantFieldName, opts...)
+}
+
+// RegisterInterfaceType is RegisterInterface taking the interface type itself, for callers such as
+// generated code that hold a reflect.Type rather than a pointer to the interface
+// iFaceType: the interface type (e.g., reflect.TypeOf((*Shape)(nil)).Elem())
+func (p *Poly) RegisterInterfaceType(
+	iFaceType reflect.Type,
+	discriminantFieldName string,
+	opts ...InterfaceOption) error {
+	if iFaceType == nil || iFaceType.Kind() != reflect.Interface {
+		return fmt.Errorf("poly: interface type must be an interface, got %v", iFaceType)
+	}
+	if p.isAny(iFaceType) {
+		return errors.New("poly: cannot register unnamed interface interface {}, see ResolveAny to resolve `any` values")
+	}
+	if iFaceType.Name() == "" && p.KeyFunc == nil {
+		return fmt.Errorf("poly: cannot register unnamed interface %s, declare a named interface type for it or set KeyFunc", iFaceType)
+	}
 	if p.types == nil {
-		p.types = make(map[string]*polyType)
+		p.types = make(map[reflect.Type]*polyType)
 	}
-	_, ok := p.types[key]
+	_, ok := p.types[iFaceType]
 	if ok {
 		return errors.New("poly: interface already registered")
 	}
-	p.types[key] = &polyType{
+	entry := &polyType{
 		fieldType:             iFaceType,
 		discriminantFieldName: discriminantFieldName,
 	}
+	for _, opt := range opts {
+		opt(entry)
+	}
+	if entry.discriminantQuery != "" && !jsonQueries {
+		return errors.New("poly: DiscriminantQuery needs the gjson backend; build without the polystdjson tag")
+	}
+	if entry.compositeFields != nil {
+		if err := p.checkComposite(entry); err != nil {
+			return err
+		}
+	}
+	if entry.parentLevels != 0 || entry.parentPath != "" {
+		if err := p.checkParent(entry); err != nil {
+			return err
+		}
+	}
+	if entry.ignoreUnknown && entry.rejectUnknown {
+		return errors.New("poly: IgnoreUnknown and RejectUnknown cannot be combined")
+	}
+	if entry.normalize != nil && (entry.externallyTagged || entry.compositeFields != nil) {
+		return errors.New("poly: NormalizeDiscriminant cannot be combined with ExternallyTagged or DiscriminantFields")
+	}
+	if entry.discriminantMethod != "" {
+		if err := p.checkMethod(entry); err != nil {
+			return err
+		}
+	}
+	if err := p.checkFieldName(entry); err != nil {
+		return err
+	}
+	if entry.singleStruct && (entry.discriminantFieldName != "" || entry.discriminantQuery != "" ||
+		entry.compositeFields != nil || entry.parentLevels != 0 || entry.externallyTagged ||
+		entry.defaultStruct != nil || entry.requireDiscriminant || entry.resolveAny) {
+		return errors.New("poly: SingleStruct takes an empty discriminantFieldName and no option locating the discriminant")
+	}
+	if entry.defaultStruct != nil {
+		if _, err := p.structType(reflect.Zero(entry.defaultStruct).Interface()); err != nil {
+			return fmt.Errorf("poly: default struct of interface %s: %w", p.typeKey(iFaceType), err)
+		}
+		if entry.requireDiscriminant {
+			return errors.New("poly: DefaultStruct and RequireDiscriminant cannot be combined")
+		}
+	}
+	if entry.resolveAny {
+		if p.anyInterface != nil {
+			return fmt.Errorf("poly: interface %s already resolves any values", p.typeKey(p.anyInterface.fieldType))
+		}
+		p.anyInterface = entry
+	}
+	entry.order = len(p.types)
+	p.types[iFaceType] = entry
+	return nil
+}
+
+// checkFieldName checks that the discriminant field path of entry names a member at every level,
+// and is only empty when an option locates the discriminant without it
+func (p *Poly) checkFieldName(entry *polyType) error {
+	if entry.discriminantFieldName == "" {
+		if entry.externallyTagged || entry.compositeFields != nil || entry.discriminantQuery != "" ||
+			entry.parentLevels != 0 || entry.singleStruct {
+			return nil
+		}
+		return fmt.Errorf("poly: interface %s needs a discriminantFieldName", p.typeKey(entry.fieldType))
+	}
+	for _, segment := range splitJSONPath(entry.discriminantFieldName) {
+		if segment == "" {
+			return fmt.Errorf("poly: discriminant field path %q of interface %s has an empty segment",
+				entry.discriminantFieldName, p.typeKey(entry.fieldType))
+		}
+	}
 	return nil
 }
 
+// typeKey returns the name of an interface type used in messages, given by KeyFunc if it is set
+func (p *Poly) typeKey(iFaceType reflect.Type) string {
+	if p.KeyFunc != nil {
+		return p.KeyFunc(iFaceType)
+	}
+	return iFaceType.PkgPath() + "." + iFaceType.Name()
+}
+
 // structType validates and extracts the reflect.Type from a struct pointer
 func (p *Poly) structType(structPtr any) (reflect.Type, error) {
 	structPtrType := reflect.TypeOf(structPtr)
@@ -95,194 +523,1758 @@ func (p *Poly) iFaceType(iFacePtr any) (reflect.Type, error) {
 // RegisterStruct registers a struct implementation for an interface
 // iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
 // structPtr: a pointer to the struct type (e.g., (*Circle)(nil))
-// value: the discriminant value for this struct (e.g., "circle")
+// value: the discriminant value for this struct (e.g., "circle"). It must be comparable with what
+// JSON decodes to: a string, number, bool, or a map or slice of those for object or array discriminants
 func (p *Poly) RegisterStruct(
 	iFacePtr any,
 	structPtr any,
 	value any) error {
+	structType, err := p.structType(structPtr)
+	if err != nil {
+		return err
+	}
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return err
+	}
+	return p.RegisterStructType(iFaceType, structType, value)
+}
+
+// RegisterStructType is RegisterStruct taking the interface and struct types themselves
+// iFaceType: the interface type (e.g., reflect.TypeOf((*Shape)(nil)).Elem())
+// structType: the struct type (e.g., reflect.TypeOf(Circle{}))
+func (p *Poly) RegisterStructType(iFaceType reflect.Type, structType reflect.Type, value any) error {
+	if iFaceType == nil || iFaceType.Kind() != reflect.Interface {
+		return fmt.Errorf("poly: interface type must be an interface, got %v", iFaceType)
+	}
+	if structType == nil || structType.Kind() != reflect.Struct {
+		return fmt.Errorf("poly: struct type must be a struct, got %v", structType)
+	}
+	return p.registerStruct(iFaceType, structType, value, func() any {
+		return reflect.New(structType).Interface()
+	}, nil)
+}
+
+// RegisterStructFunc registers a struct implementation for an interface like RegisterStruct, but creates
+// the instances to unmarshal into with creator, so they can start from defaults instead of zero values.
+// Fields absent in the JSON keep the values set by creator
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// value: the discriminant value for this struct (e.g., "circle")
+// creator: returns a new pointer to the struct on every call (e.g., func() any { return &Circle{Radius: 1} })
+func (p *Poly) RegisterStructFunc(
+	iFacePtr any,
+	value any,
+	creator func() any) error {
+	if creator == nil {
+		return errors.New("poly: creator must not be nil")
+	}
+	sample := creator()
+	if sample == nil {
+		return errors.New("poly: creator must return a struct pointer, got nil")
+	}
+	structType, err := p.structType(sample)
+	if err != nil {
+		return err
+	}
 	iFaceType, err := p.iFaceType(iFacePtr)
 	if err != nil {
 		return err
 	}
+	return p.registerStruct(iFaceType, structType, value, creator, nil)
+}
+
+// RegisterStructMatch registers a struct implementation for an interface that Unmarshal resolves for every
+// discriminant match accepts, such as a range of opcodes, instead of a single value. Registrations are tried
+// in the order they were made, those of RegisterStruct included, and the first one matching wins, so a value
+// registered before a predicate accepting it too still resolves to its own struct
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// structPtr: a pointer to the struct type (e.g., (*Circle)(nil))
+// match: reports whether the discriminant, as JSON decodes it into `any` (a float64, string, bool, nil,
+// map[string]any or []any), selects this struct
+// marshalValue: the discriminant value stamped on marshal, see PreserveExistingDiscriminant to keep
+// the one a struct already carries
+func (p *Poly) RegisterStructMatch(
+	iFacePtr any,
+	structPtr any,
+	match func(any) bool,
+	marshalValue any) error {
+	if match == nil {
+		return errors.New("poly: match must not be nil")
+	}
 	structType, err := p.structType(structPtr)
 	if err != nil {
 		return err
 	}
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return err
+	}
+	return p.registerStruct(iFaceType, structType, marshalValue, func() any {
+		return reflect.New(structType).Interface()
+	}, match)
+}
+
+// registerStruct registers structType as an implementation of the interface, created by creator
+// and matched by match if it is not nil
+func (p *Poly) registerStruct(
+	iFaceType reflect.Type,
+	structType reflect.Type,
+	value any,
+	creator func() any,
+	match func(any) bool) error {
+	var err error
 	if !reflect.PointerTo(structType).Implements(iFaceType) {
 		return errors.New("poly: interface type mismatch, struct ptr must implements interface")
 	}
-	key := iFaceType.PkgPath() + "." + iFaceType.Name()
-	entry, ok := p.types[key]
+	key := p.typeKey(iFaceType)
+	entry, ok := p.types[iFaceType]
 	if !ok {
 		return fmt.Errorf("poly: interface type %s not registered", key)
 	}
-	structFieldPos := -1
-	for i := 0; i < structType.NumField(); i++ {
-		f := structType.Field(i)
-		jsonTag := f.Tag.Get("json")
-		if jsonTag == "" {
-			continue
+	if match != nil && (entry.compositeFields != nil || entry.externallyTagged || entry.singleStruct) {
+		return fmt.Errorf("poly: interface %s cannot match structs by predicate", key)
+	}
+	var structFieldPos []int
+	var compositePos [][]int
+	if entry.compositeFields != nil {
+		if compositePos, err = p.compositeFieldIndexes(entry, structType, value); err != nil {
+			return err
 		}
-		fieldName := strings.Split(jsonTag, ",")[0]
-		if fieldName == entry.discriminantFieldName {
-			structFieldPos = i
-			break
+	} else if entry.discriminantMethod != "" {
+		if value, err = p.methodDiscriminant(entry, structType, value); err != nil {
+			return err
+		}
+		entry.discriminantKind = reflect.ValueOf(value).Kind()
+	} else if entry.singleStruct {
+		if len(entry.structTypes) != 0 {
+			return fmt.Errorf("poly: interface %s takes a single struct, %s is already registered", key, entry.structTypes[0])
+		}
+	} else if entry.externallyTagged {
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("poly: externally tagged interface %s needs a string key, got %T", key, value)
+		}
+		entry.discriminantKind = reflect.String
+	} else if entry.discriminantFieldName != "" || (entry.discriminantQuery == "" && entry.parentLevels == 0) {
+		var fieldType reflect.Type
+		structFieldPos, fieldType, err = p.discriminantFieldIndex(entry, structType, entry.discriminantFieldName)
+		if errors.Is(err, errDiscriminantNotFound) {
+			return fmt.Errorf("poly: interface type %s not found in struct %s, %s",
+				key, structType, p.missingFieldHint(entry, structType, entry.discriminantFieldName))
+		} else if err != nil {
+			return err
 		}
+		if !p.discriminantAssignable(value, fieldType) {
+			return fmt.Errorf("poly: discriminant value %#v of struct %s cannot be stored in its field of type %s",
+				value, structType, fieldType)
+		}
+		// a *string field holds the same discriminants as a string one
+		kind := p.pointee(fieldType).Kind()
+		if len(entry.structTypes) != 0 && kind != entry.discriminantKind {
+			return fmt.Errorf("poly: discriminant field of struct %s is %s, but registered structs of interface %s use %s",
+				structType, kind, key, entry.discriminantKind)
+		}
+		entry.discriminantKind = kind
+	}
+
+	p.appendStruct(entry, structType, value, creator, match, structFieldPos, compositePos)
+	return nil
+}
+
+// appendStruct adds the registration of structType to entry
+func (p *Poly) appendStruct(
+	entry *polyType,
+	structType reflect.Type,
+	value any,
+	creator func() any,
+	match func(any) bool,
+	structFieldPos []int,
+	compositePos [][]int) {
+	if p.structEntries == nil {
+		p.structEntries = make(map[reflect.Type]*polyType)
 	}
-	if structFieldPos == -1 {
-		return fmt.Errorf("poly: interface type %s not found in struct", key)
+	if _, ok := p.structEntries[structType]; !ok {
+		p.structEntries[structType] = entry
 	}
 
 	entry.structValues = append(entry.structValues, value)
-	entry.structCreators = append(entry.structCreators, func() any {
-		return reflect.New(structType).Interface()
-	})
+	entry.structMatchers = append(entry.structMatchers, match)
+	entry.hasMatchers = entry.hasMatchers || match != nil
+	entry.structCreators = append(entry.structCreators, creator)
 	entry.structTypes = append(entry.structTypes, structType)
 	entry.structFieldPos = append(entry.structFieldPos, structFieldPos)
-
-	return nil
+	entry.structCompositePos = append(entry.structCompositePos, compositePos)
+	p.registrations++
+	entry.structIDs = append(entry.structIDs, p.registrations)
 }
 
-// beforeMarshalJSONValue recursively processes values before JSON marshaling
-// It sets discriminant field values for interface implementations
-func (p *Poly) beforeMarshalJSONValue(val reflect.Value, strict bool) error {
-	if val.Kind() == reflect.Ptr {
-		val = val.Elem()
-	}
-	// if it is interface
-	if val.Kind() == reflect.Interface {
-		iFaceType := val.Type()
-		key := iFaceType.PkgPath() + "." + iFaceType.Name()
-		entry, ok := p.types[key]
-		if !ok { // is interface and not found
-			if strict {
-				return fmt.Errorf("poly: interface type %s not registered", key)
-			} else {
-				return nil
+// errDiscriminantNotFound reports a struct without a field at the discriminant field path
+var errDiscriminantNotFound = errors.New("poly: discriminant field not found")
+
+// discriminantFieldIndex locates the discriminant field by following the dotted json field path
+// through nested structs, and returns its index path suitable for reflect.Value.FieldByIndex
+// together with the type of the discriminant field. Fields promoted from embedded structs are
+// considered too, and more than one field with the same json name is reported as ambiguous.
+// Untagged fields are only matched under UntaggedDiscriminant, when no tagged field matches
+func (p *Poly) discriminantFieldIndex(entry *polyType, structType reflect.Type, fieldPath string) ([]int, reflect.Type, error) {
+	var index []int
+	t := structType
+	for i, segment := range splitJSONPath(fieldPath) {
+		if i > 0 {
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() != reflect.Struct {
+				return nil, nil, errDiscriminantNotFound
 			}
 		}
-		val = val.Elem()
-		if val.Kind() == reflect.Ptr {
-			val = val.Elem()
+		found := p.jsonFieldIndexes(t, segment, false, nil)
+		if len(found) == 0 && entry.untaggedDiscriminant {
+			found = p.jsonFieldIndexes(t, segment, true, nil)
 		}
-		found := false
-		for pos, sType := range entry.structTypes {
-			if sType != val.Type() {
-				continue
-			}
-			fieldOffset := entry.structFieldPos[pos]
-			val.Field(fieldOffset).Set(reflect.ValueOf(entry.structValues[pos]))
-			found = true
-			break
+		if len(found) == 0 {
+			return nil, nil, errDiscriminantNotFound
 		}
-		if !found {
-			return fmt.Errorf("poly: interface type %s not found in struct", key)
+		if len(found) > 1 {
+			return nil, nil, fmt.Errorf("poly: discriminant field %s of struct %s is ambiguous, %d fields are named %s",
+				fieldPath, structType, len(found), segment)
 		}
+		index = append(index, found[0]...)
+		t = t.FieldByIndex(found[0]).Type
 	}
-	if val.Kind() == reflect.Struct {
-		for i := 0; i < val.NumField(); i++ {
-			err := p.beforeMarshalJSONValue(val.Field(i), strict)
-			if err != nil {
-				return err
-			}
+	return index, t, nil
+}
+
+// missingFieldHint describes where the field path of a discriminant not found in structType goes wrong,
+// listing the json field names available at that level so that a misspelt name stands out
+func (p *Poly) missingFieldHint(entry *polyType, structType reflect.Type, fieldPath string) string {
+	t := structType
+	for _, segment := range splitJSONPath(fieldPath) {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
 		}
-	} else if val.Kind() == reflect.Slice {
-		for i := 0; i < val.Len(); i++ {
-			err := p.beforeMarshalJSONValue(val.Index(i), strict)
-			if err != nil {
-				return err
+		if t.Kind() != reflect.Struct {
+			return fmt.Sprintf("discriminant field %s reaches %s, which is not a struct", fieldPath, t)
+		}
+		found := p.jsonFieldIndexes(t, segment, false, nil)
+		if len(found) == 0 && entry.untaggedDiscriminant {
+			found = p.jsonFieldIndexes(t, segment, true, nil)
+		}
+		if len(found) != 1 {
+			names := p.jsonFieldNames(t, entry.untaggedDiscriminant, nil)
+			if len(names) == 0 {
+				return fmt.Sprintf("%s has no json fields", t)
 			}
+			return fmt.Sprintf("json fields of %s are %s", t, strings.Join(names, ", "))
 		}
+		t = t.FieldByIndex(found[0]).Type
 	}
-	return nil
-}
-
-// BeforeMarshalJSON prepares a value for JSON marshaling by setting discriminant fields
-// Call this before json.Marshal to ensure interface implementations are correctly tagged
-func (p *Poly) BeforeMarshalJSON(ptr any, strict bool) error {
-	return p.beforeMarshalJSONValue(reflect.ValueOf(ptr), strict)
+	return ""
 }
 
-// beforeUnmarshalJSONValue recursively processes values before JSON unmarshaling
-// It creates appropriate concrete types based on discriminant field values
-func (p *Poly) beforeUnmarshalJSONValue(prefix []string, val reflect.Value, buf []byte, strict bool) error {
-	if val.Kind() == reflect.Ptr {
-		val = val.Elem()
+// jsonFieldNames returns the sorted json names of the tagged fields of struct type t, and of the untagged
+// ones if untagged is set, including fields promoted from embedded structs
+func (p *Poly) jsonFieldNames(t reflect.Type, untagged bool, seen map[reflect.Type]bool) []string {
+	if seen[t] {
+		return nil
 	}
-
-	if val.Kind() == reflect.Interface {
-		iFaceType := val.Type()
-		key := iFaceType.PkgPath() + "." + iFaceType.Name()
-		entry, ok := p.types[key]
-		if !ok {
-			if strict {
-				return fmt.Errorf("poly: interface type %s not registered", key)
-			} else {
-				return nil
+	if seen == nil {
+		seen = make(map[reflect.Type]bool)
+	}
+	seen[t] = true
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !p.isVisible(f) {
+			continue
+		}
+		if p.isPromoted(f) {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
 			}
+			names = append(names, p.jsonFieldNames(embedded, untagged, seen)...)
+			continue
 		}
-		fieldName := entry.discriminantFieldName
-
-		fieldPath := strings.Join(append(prefix, fieldName), ".")
-		inputVal := gjson.GetBytes(buf, fieldPath)
-		var iVal any
-		if inputVal.Exists() {
-			iVal = inputVal.Value()
-		} else {
-			iVal = reflect.New(reflect.TypeOf(entry.structValues[0])).Elem().Interface()
+		if !p.isTagged(t, f) && !untagged {
+			continue
+		}
+		if name, ok := p.jsonFieldName(t, f); ok {
+			names = append(names, name)
 		}
+	}
+	sort.Strings(names)
+	return names
+}
 
-		set := false
-		for pos, dVal := range entry.structValues {
-			if iVal != dVal {
-				continue
+// jsonFieldIndexes returns the index paths of the tagged fields of struct type t named name in JSON,
+// or of the untagged ones named name in Go if untagged is set, including fields promoted from embedded
+// structs. seen guards against embedding cycles
+func (p *Poly) jsonFieldIndexes(t reflect.Type, name string, untagged bool, seen map[reflect.Type]bool) [][]int {
+	if seen[t] {
+		return nil
+	}
+	if seen == nil {
+		seen = make(map[reflect.Type]bool)
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	var found [][]int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !p.isVisible(f) {
+			continue
+		}
+		if p.isPromoted(f) {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
 			}
-			refVal := reflect.ValueOf(entry.structCreators[pos]())
-			val.Set(refVal)
-			set = true
-			break
+			for _, index := range p.jsonFieldIndexes(embedded, name, untagged, seen) {
+				found = append(found, append([]int{i}, index...))
+			}
+			continue
 		}
-		if !set {
-			return fmt.Errorf("poly: cannot resolve interface %s type by field path %s, raw json %s ", key, fieldPath, string(buf))
+		if p.isTagged(t, f) == untagged {
+			continue
 		}
-		val = val.Elem()
-		if val.Kind() == reflect.Ptr {
-			val = val.Elem()
+		if fieldName, ok := p.jsonFieldName(t, f); ok && fieldName == name {
+			found = append(found, []int{i})
 		}
 	}
-	if val.Kind() == reflect.Struct {
-		for i := 0; i < val.NumField(); i++ {
-			jsonTag := val.Type().Field(i).Tag.Get("json")
-			if jsonTag == "" {
+	return found
+}
+
+// jsonFieldName returns the name the field f of struct type t has on the wire: the one registered with
+// RegisterWireNames, or else the one encoding/json uses, following its tag semantics: "-" skips the field,
+// "-," names it literally "-", and an empty name falls back to the Go field name
+func (p *Poly) jsonFieldName(t reflect.Type, f reflect.StructField) (string, bool) {
+	if name, ok := p.wireNames[t][f.Name]; ok {
+		return name, true
+	}
+	jsonTag := f.Tag.Get("json")
+	if jsonTag == "-" {
+		return "", false
+	}
+	fieldName, _, _ := strings.Cut(jsonTag, ",")
+	if fieldName == "" {
+		fieldName = f.Name
+	}
+	return fieldName, true
+}
+
+// isTagged reports whether the field f of struct type t has a json tag or a name registered with RegisterWireNames
+func (p *Poly) isTagged(t reflect.Type, f reflect.StructField) bool {
+	_, ok := p.wireNames[t][f.Name]
+	return ok || f.Tag.Get("json") != ""
+}
+
+// isPromoted reports whether encoding/json promotes the fields of an embedded struct field
+// into the enclosing object instead of nesting them under the field name. Embedded interfaces are
+// not promoted, encoding/json nests them under their type name like named fields
+func (p *Poly) isPromoted(f reflect.StructField) bool {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); !f.Anonymous || name != "" {
+		return false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// isVisible reports whether encoding/json looks at the struct field at all. Unexported fields are
+// ignored, except embedded structs whose exported fields are promoted
+func (p *Poly) isVisible(f reflect.StructField) bool {
+	return f.IsExported() || p.isPromoted(f)
+}
+
+// marshalsItself reports whether encoding/json marshals values of type t through json.Marshaler
+// or encoding.TextMarshaler, in which case the traversal treats them as opaque leaves,
+// unless their wire names are registered with RegisterWireNames
+func (p *Poly) marshalsItself(t reflect.Type) bool {
+	if _, ok := p.wireNames[t]; ok || t.Kind() == reflect.Interface {
+		return false
+	}
+	pt := reflect.PointerTo(t)
+	return t.Implements(jsonMarshalerType) || pt.Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || pt.Implements(textMarshalerType)
+}
+
+// unmarshalsItself reports whether encoding/json unmarshals values of type t through json.Unmarshaler
+// or encoding.TextUnmarshaler, in which case the traversal treats them as opaque leaves,
+// unless their wire names are registered with RegisterWireNames
+func (p *Poly) unmarshalsItself(t reflect.Type) bool {
+	if _, ok := p.wireNames[t]; ok || t.Kind() == reflect.Interface {
+		return false
+	}
+	pt := reflect.PointerTo(t)
+	return pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType)
+}
+
+// pointsToInterface reports whether t is a chain of pointers ending in an interface,
+// or in a slice, map or struct that may hold interfaces
+func (p *Poly) pointsToInterface(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Slice, reflect.Map, reflect.Struct:
+		return p.mayHoldInterface(t, nil)
+	}
+	return false
+}
+
+// discriminantValue converts a registered discriminant value to the declared type of the field
+// it is stamped into, e.g. a plain string registered for a field of type `type Kind string`,
+// or a newly allocated *string pointing to it for a field of type *string
+func (p *Poly) discriminantValue(value any, fieldType reflect.Type) reflect.Value {
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(fieldType) {
+		return v
+	}
+	if fieldType.Kind() == reflect.Ptr {
+		ptr := reflect.New(fieldType.Elem())
+		ptr.Elem().Set(p.discriminantValue(value, fieldType.Elem()))
+		return ptr
+	}
+	if v.Type().ConvertibleTo(fieldType) {
+		v = v.Convert(fieldType)
+	}
+	return v
+}
+
+// discriminantAssignable reports whether discriminantValue can store value into a field of fieldType
+// without changing its meaning, which rules out conversions such as int to string
+func (p *Poly) discriminantAssignable(value any, fieldType reflect.Type) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return false
+	}
+	if v.Type().AssignableTo(fieldType) {
+		return true
+	}
+	if fieldType.Kind() == reflect.Ptr {
+		return p.discriminantAssignable(value, fieldType.Elem())
+	}
+	return v.Type().ConvertibleTo(fieldType) && p.discriminantFits(value, fieldType)
+}
+
+// discriminantFits reports whether a registered discriminant value keeps its meaning in a field of fieldType,
+// i.e. it is assignable or of the same kind, or both are numbers
+func (p *Poly) discriminantFits(value any, fieldType reflect.Type) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return false
+	}
+	if !v.Type().AssignableTo(fieldType) {
+		fieldType = p.pointee(fieldType)
+	}
+	if v.Type().AssignableTo(fieldType) || v.Kind() == fieldType.Kind() {
+		return true
+	}
+	_, valueIsNumber := p.numericValue(v)
+	_, fieldIsNumber := p.numericValue(reflect.Zero(fieldType))
+	return valueIsNumber && fieldIsNumber
+}
+
+// pointee returns the type a discriminant field of type t points to, or t itself when it is not a pointer.
+// *big.Int fields are numbers of their own
+func (p *Poly) pointee(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr && t.Elem() != bigIntType {
+		return t.Elem()
+	}
+	return t
+}
+
+// fieldDiscriminant returns the discriminant held by the field, through a pointer for pointer fields
+// other than *big.Int
+func (p *Poly) fieldDiscriminant(field reflect.Value) any {
+	if p.pointee(field.Type()) != field.Type() && !field.IsNil() {
+		field = field.Elem()
+	}
+	return field.Interface()
+}
+
+// matchDiscriminant returns the position of the struct registered for the discriminant iVal read from JSON,
+// or -1 when there is none
+func (p *Poly) matchDiscriminant(entry *polyType, iVal any) int {
+	for pos, dVal := range entry.structValues {
+		if entry.structMatchers[pos] == nil && p.discriminantMatches(iVal, dVal) && !p.discriminantless(entry, pos) {
+			return pos
+		}
+	}
+	return -1
+}
+
+// matchString returns the position of the struct registered for the string discriminant s read from JSON,
+// or -1 when there is none. It matches like matchDiscriminant without boxing s
+func (p *Poly) matchString(entry *polyType, s string) int {
+	for pos, dVal := range entry.structValues {
+		if entry.structMatchers[pos] != nil {
+			continue
+		}
+		if text, ok := p.discriminantText(dVal); ok {
+			if text == s {
+				return pos
+			}
+		} else if v := reflect.ValueOf(dVal); v.Kind() == reflect.String && v.Type() != jsonNumberType && v.String() == s {
+			return pos
+		}
+	}
+	return -1
+}
+
+// member returns the member of the object node named name the way encoding/json finds the member decoded
+// into a field: it decodes every member whose name equals name, exactly or under Unicode case folding,
+// so the last one is returned. The elements of an array node are indexed by name
+func (p *Poly) member(node jsonNode, name string) jsonNode {
+	if !node.IsObject() {
+		return node.Member(name)
+	}
+	var found jsonNode
+	node.ForEach(func(key string, value jsonNode) bool {
+		if key == name || strings.EqualFold(key, name) {
+			found = value
+		}
+		return true
+	})
+	return found
+}
+
+// lookup returns the value at the dotted field path of node, finding the members along it with member
+func (p *Poly) lookup(node jsonNode, path string) jsonNode {
+	if !strings.ContainsAny(path, ".\\") {
+		return p.member(node, path)
+	}
+	for _, segment := range splitJSONPath(path) {
+		node = p.member(node, segment)
+	}
+	return node
+}
+
+// locateDiscriminant returns the discriminant of entry in the object node, found by the query of
+// DiscriminantQuery or else looked up along its field path
+func (p *Poly) locateDiscriminant(entry *polyType, node jsonNode) jsonNode {
+	if entry.discriminantQuery != "" {
+		return node.Get(entry.discriminantQuery)
+	}
+	return p.lookup(node, p.discriminantLocator(entry))
+}
+
+// discriminantLocator returns the path or query locating the discriminant of the interface in JSON,
+// the first field path of a composite discriminant, or the path below the node ParentDiscriminant climbs to
+func (p *Poly) discriminantLocator(entry *polyType) string {
+	if entry.discriminantQuery != "" {
+		return entry.discriminantQuery
+	} else if entry.parentLevels != 0 {
+		return entry.parentPath
+	} else if entry.compositeFields != nil {
+		return entry.compositeFields[0]
+	}
+	return entry.discriminantFieldName
+}
+
+// matchObject returns the position of the struct registered for the discriminant of the object node,
+// or for the fields it holds when it has none, or else of the fallback struct, or -1 when there is none
+func (p *Poly) matchObject(entry *polyType, node jsonNode) int {
+	if entry.singleStruct {
+		return len(entry.structTypes) - 1
+	} else if entry.compositeFields != nil {
+		return p.matchComposite(entry, node)
+	}
+	discriminant := p.locateDiscriminant(entry, node)
+	if entry.presence != nil && !discriminant.Exists() {
+		if pos := p.presenceMatch(entry, node); pos != -1 {
+			return pos
+		}
+	}
+	if pos := p.matchNode(entry, discriminant); pos != -1 || entry.fallbackStruct == nil {
+		return pos
+	}
+	return p.fallbackMatch(entry)
+}
+
+// discriminantOf returns the discriminant of the object node as a Go value for messages
+func (p *Poly) discriminantOf(entry *polyType, node jsonNode) any {
+	if entry.compositeFields != nil {
+		values := make([]any, len(entry.compositeFields))
+		for i, field := range entry.compositeFields {
+			values[i] = p.lookup(node, field).Value()
+		}
+		return values
+	}
+	return p.locateDiscriminant(entry, node).Value()
+}
+
+// matchNode returns the position of the struct registered for the discriminant node read from JSON,
+// or -1 when there is none. An absent discriminant resolves as absentMatch says
+func (p *Poly) matchNode(entry *polyType, inputVal jsonNode) int {
+	if entry.normalize != nil && inputVal.Exists() {
+		return p.matchNormalized(entry, entry.normalize(inputVal.Value()))
+	}
+	if entry.hasMatchers && inputVal.Exists() {
+		return p.matchPredicate(entry, p.matchValue(entry, inputVal), inputVal.Value())
+	}
+	return p.matchValue(entry, inputVal)
+}
+
+// matchNormalized returns the position of the first struct whose normalized registered value, or predicate,
+// matches the normalized discriminant value, or -1 when there is none
+func (p *Poly) matchNormalized(entry *polyType, value any) int {
+	for pos, dVal := range entry.structValues {
+		if match := entry.structMatchers[pos]; match != nil {
+			if match(value) {
+				return pos
+			}
+		} else if p.discriminantMatches(value, entry.normalize(dVal)) {
+			return pos
+		}
+	}
+	return -1
+}
+
+// matchPredicate returns the position of the first struct registered with RegisterStructMatch whose
+// predicate accepts the discriminant value, if it was registered before pos, the position matched by value
+func (p *Poly) matchPredicate(entry *polyType, pos int, value any) int {
+	for i, match := range entry.structMatchers {
+		if i == pos {
+			break
+		}
+		if match != nil && match(value) {
+			return i
+		}
+	}
+	return pos
+}
+
+// matchValue is matchNode for the structs registered with a discriminant value
+func (p *Poly) matchValue(entry *polyType, inputVal jsonNode) int {
+	if s, ok := inputVal.Str(); ok {
+		// strings are the common case, match them without boxing
+		pos := p.matchString(entry, s)
+		if pos == -1 && entry.numericStrings && p.isJSONNumber(s) {
+			value, _ := strconv.ParseFloat(s, 64)
+			pos = p.matchNumber(entry, s, value)
+		}
+		return pos
+	} else if !inputVal.Exists() {
+		return p.absentMatch(entry)
+	} else if p.jsonKind(inputVal) == "number" {
+		return p.matchNumber(entry, inputVal.Raw(), inputVal.Value())
+	}
+	return p.matchDiscriminant(entry, inputVal.Value())
+}
+
+// isJSONNumber reports whether s is written as a JSON number
+func (p *Poly) isJSONNumber(s string) bool {
+	return s != "" && (s[0] == '-' || s[0] >= '0' && s[0] <= '9') && json.Valid([]byte(s))
+}
+
+// matchNumber returns the position of the struct registered for the JSON number raw, value as float64,
+// or -1 when there is none. Integers are compared exactly with integer, json.Number and big.Int
+// discriminants, so those beyond float64 precision still tell variants apart
+func (p *Poly) matchNumber(entry *polyType, raw string, value any) int {
+	exact, isInt := new(big.Int).SetString(raw, 10)
+	for pos, dVal := range entry.structValues {
+		if entry.structMatchers[pos] == nil && p.numberMatches(exact, isInt, value, dVal) {
+			return pos
+		}
+	}
+	return -1
+}
+
+// numberMatches reports whether the JSON number value, exact if isInt, matches the registered dVal
+func (p *Poly) numberMatches(exact *big.Int, isInt bool, value any, dVal any) bool {
+	if _, ok := p.discriminantText(dVal); ok {
+		// encoding/json writes the value as text, never as a number
+		return false
+	}
+	if d, ok := p.exactInteger(dVal); ok && isInt {
+		return d.Cmp(exact) == 0
+	}
+	return p.discriminantMatches(value, dVal)
+}
+
+// exactInteger returns the registered discriminant dVal as a big.Int if it is an integer
+func (p *Poly) exactInteger(dVal any) (*big.Int, bool) {
+	v := reflect.ValueOf(dVal)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Int).SetUint64(v.Uint()), true
+	case reflect.String:
+		if v.Type() == jsonNumberType {
+			return new(big.Int).SetString(v.String(), 10)
+		}
+	case reflect.Ptr:
+		if v.Type().Elem() == bigIntType && !v.IsNil() {
+			return v.Interface().(*big.Int), true
+		}
+	}
+	return nil, false
+}
+
+// absentMatch returns the position of the struct used when the JSON carries no discriminant: the one
+// nominated by DefaultStruct, or else the one registered with the zero discriminant value, or -1
+func (p *Poly) absentMatch(entry *polyType) int {
+	if entry.requireDiscriminant {
+		return -1
+	}
+	if entry.defaultStruct != nil {
+		for pos, structType := range entry.structTypes {
+			if reflect.PointerTo(structType) == entry.defaultStruct {
+				return pos
+			}
+		}
+		return -1
+	}
+	for pos, dVal := range entry.structValues {
+		if entry.structMatchers[pos] != nil {
+			continue
+		}
+		if v := reflect.ValueOf(dVal); v.IsValid() && (v.IsZero() || entry.compositeFields != nil && p.compositeZero(v)) {
+			return pos
+		}
+	}
+	return -1
+}
+
+// discriminantText returns the text encoding/json writes for the discriminant value v when its type
+// implements encoding.TextMarshaler and not json.Marshaler, such as an enum named by its text
+func (p *Poly) discriminantText(v any) (string, bool) {
+	if _, ok := v.(json.Marshaler); ok {
+		return "", false
+	}
+	marshaler, ok := v.(encoding.TextMarshaler)
+	if !ok {
+		return "", false
+	}
+	text, err := marshaler.MarshalText()
+	return string(text), err == nil
+}
+
+// discriminantMatches reports whether the discriminant read from JSON matches a registered value.
+// Values are compared by their underlying kind, so defined types such as `type Kind string` match
+// the plain string read from JSON, and integers, json.Number and *big.Int match the float64 numbers
+// read from JSON. Values encoding/json writes as text through encoding.TextMarshaler match by their text.
+// Objects and arrays match member by member, other values that are not comparable by reflect.DeepEqual
+func (p *Poly) discriminantMatches(iVal any, dVal any) bool {
+	iv, dv := reflect.ValueOf(iVal), reflect.ValueOf(dVal)
+	if !iv.IsValid() || !dv.IsValid() {
+		return !iv.IsValid() && !dv.IsValid()
+	}
+	if dText, ok := p.discriminantText(dVal); ok {
+		iText, ok := p.discriminantText(iVal)
+		if !ok && iv.Kind() == reflect.String && iv.Type() != jsonNumberType {
+			iText, ok = iv.String(), true
+		}
+		return ok && iText == dText
+	}
+	switch dv.Kind() {
+	case reflect.String:
+		if dv.Type() != jsonNumberType {
+			return iv.Kind() == reflect.String && iv.Type() != jsonNumberType && iv.String() == dv.String()
+		}
+	case reflect.Bool:
+		return iv.Kind() == reflect.Bool && iv.Bool() == dv.Bool()
+	case reflect.Map:
+		if iv.Kind() != reflect.Map || iv.Len() != dv.Len() ||
+			iv.Type().Key().Kind() != reflect.String || dv.Type().Key().Kind() != reflect.String {
+			return false
+		}
+		iter := dv.MapRange()
+		for iter.Next() {
+			member := iv.MapIndex(reflect.ValueOf(iter.Key().String()).Convert(iv.Type().Key()))
+			if !member.IsValid() || !p.discriminantMatches(member.Interface(), iter.Value().Interface()) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if (iv.Kind() != reflect.Slice && iv.Kind() != reflect.Array) || iv.Len() != dv.Len() {
+			return false
+		}
+		for i := 0; i < dv.Len(); i++ {
+			if !p.discriminantMatches(iv.Index(i).Interface(), dv.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	if dNum, ok := p.numericValue(dv); ok {
+		iNum, ok := p.numericValue(iv)
+		return ok && iNum == dNum
+	}
+	if !iv.Type().Comparable() || !dv.Type().Comparable() {
+		return reflect.DeepEqual(iVal, dVal)
+	}
+	return iVal == dVal
+}
+
+// numericValue returns the value of a number of any numeric kind as float64
+func (p *Poly) numericValue(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		if v.Type() == jsonNumberType {
+			f, err := strconv.ParseFloat(v.String(), 64)
+			return f, err == nil
+		}
+	case reflect.Ptr:
+		if v.Type().Elem() == bigIntType && !v.IsNil() {
+			f, _ := new(big.Float).SetInt(v.Interface().(*big.Int)).Float64()
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// discriminantField returns the discriminant field of val by index path. With alloc it allocates
+// nil intermediate struct pointers so the field can be set, otherwise it returns the zero Value for them
+func (p *Poly) discriminantField(val reflect.Value, index []int, alloc bool) reflect.Value {
+	for i, pos := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				if !alloc || !val.CanSet() {
+					return reflect.Value{}
+				}
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
+		val = val.Field(pos)
+	}
+	return val
+}
+
+// stampable reports whether stampDiscriminant can set the discriminant fields of the struct val, registered
+// at position pos of entry. It cannot when a field is reached through a nil embedded pointer to an unexported
+// struct, which reflection cannot allocate any more than encoding/json can
+func (p *Poly) stampable(val reflect.Value, entry *polyType, pos int) bool {
+	indexes := entry.structCompositePos[pos]
+	if entry.structFieldPos[pos] != nil {
+		indexes = [][]int{entry.structFieldPos[pos]}
+	}
+	for _, index := range indexes {
+		field := val
+		for i, fieldPos := range index {
+			if i > 0 && field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					if !field.CanSet() {
+						return false
+					}
+					break
+				}
+				field = field.Elem()
+			}
+			field = field.Field(fieldPos)
+		}
+	}
+	return true
+}
+
+// fieldPath returns the dotted path of the discriminant at fieldName, itself a dotted path, below prefix
+func (p *Poly) fieldPath(prefix []string, fieldName string) string {
+	if len(prefix) == 0 {
+		return fieldName
+	}
+	return joinJSONPath(prefix) + "." + fieldName
+}
+
+// isAny reports whether t is the unnamed empty interface, `any` or `interface{}`
+func (p *Poly) isAny(t reflect.Type) bool {
+	return t.Kind() == reflect.Interface && t.Name() == "" && t.NumMethod() == 0
+}
+
+// resolvesAny reports whether the `any` value at node resolves against the interface registered with
+// ResolveAny, i.e. it is an object carrying the discriminant of one of its structs, or the pair
+// of a tuple tagged one
+func (p *Poly) resolvesAny(node jsonNode) bool {
+	entry := p.anyInterface
+	if entry == nil || !node.IsObject() && !(entry.tupleTagged && node.IsArray()) {
+		return false
+	}
+	if entry.externallyTagged {
+		pos, _, _ := p.externalVariant(entry, node)
+		return pos != -1
+	}
+	if entry.compositeFields != nil {
+		return p.compositeExists(entry, node) && p.matchComposite(entry, node) != -1
+	}
+	inputVal := p.locateDiscriminant(entry, node)
+	return inputVal.Exists() && p.matchNode(entry, inputVal) != -1
+}
+
+// anyEntry returns the registered interface of the struct held by val, an `any` value,
+// directly or through a pointer
+func (p *Poly) anyEntry(val reflect.Value) (*polyType, bool) {
+	if val.IsNil() {
+		return nil, false
+	}
+	t := val.Elem().Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	entry, ok := p.structEntries[t]
+	return entry, ok
+}
+
+// maxDepth returns MaxDepth, or DefaultMaxDepth when it is not set
+func (p *Poly) maxDepth() int {
+	if p.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return p.MaxDepth
+}
+
+// checkDepth returns an error when the recursion depth of the pre-pass exceeds MaxDepth
+func (p *Poly) checkDepth(depth int) error {
+	if maxDepth := p.maxDepth(); depth > maxDepth {
+		return fmt.Errorf("poly: max depth %d exceeded", maxDepth)
+	}
+	return nil
+}
+
+// contextCheckInterval is how many values the pre-pass visits between checks for cancellation
+const contextCheckInterval = 1024
+
+// traversal tracks the position of a pre-pass, which can be canceled through its context
+type traversal struct {
+	ctx     context.Context
+	visited int
+
+	// path is the JSON field path of the value visited, pushed and popped as the pre-pass
+	// descends so that it is not copied for every value
+	path []string
+}
+
+// push appends a segment to the path when descending into a child value
+func (t *traversal) push(segment string) {
+	t.path = append(t.path, segment)
+}
+
+// pop removes the last segment of the path when returning from a child value
+func (t *traversal) pop() {
+	t.path = t.path[:len(t.path)-1]
+}
+
+// pathCopy returns a copy of the path to keep beyond the visit of the current value
+func (t *traversal) pathCopy() []string {
+	return append([]string(nil), t.path...)
+}
+
+// checkContext counts a visited value and, every contextCheckInterval values, returns an error
+// when the context is done
+func (t *traversal) checkContext() error {
+	t.visited++
+	if t.ctx == nil || t.visited%contextCheckInterval != 0 {
+		return nil
+	}
+	if err := t.ctx.Err(); err != nil {
+		return fmt.Errorf("poly: pre-pass stopped: %w", err)
+	}
+	return nil
+}
+
+// stampDiscriminant sets the discriminant field of val, a struct registered at position pos of entry,
+// to its registered value, or to the zero value when clear is set
+func (p *Poly) stampDiscriminant(val reflect.Value, entry *polyType, pos int, clear bool) error {
+	if entry.compositeFields != nil {
+		return p.stampComposite(val, entry, pos, clear)
+	}
+	if entry.structFieldPos[pos] == nil {
+		// the struct has no discriminant field, its discriminant is only located by a query
+		return nil
+	}
+	// clearing needs no allocation, a nil intermediate pointer holds no discriminant
+	field := p.discriminantField(val, entry.structFieldPos[pos], !clear)
+	if clear && !field.IsValid() {
+		return nil
+	}
+	if !field.CanSet() {
+		return fmt.Errorf("poly: cannot set discriminant field of struct %s", entry.structTypes[pos])
+	}
+	if clear {
+		field.Set(reflect.Zero(field.Type()))
+	} else {
+		field.Set(p.discriminantValue(entry.structValues[pos], field.Type()))
+	}
+	return nil
+}
+
+// keepsDiscriminant reports whether the discriminant already set in the struct val is kept on marshal
+// instead of stamped, and fails when it differs from the registered value under ErrorOnDiscriminantMismatch
+func (p *Poly) keepsDiscriminant(val reflect.Value, entry *polyType, pos int) (bool, error) {
+	if !entry.preserveDiscriminant && !entry.checkDiscriminant {
+		return false, nil
+	}
+	var current any
+	if entry.compositeFields != nil {
+		var differs bool
+		if current, differs = p.compositeDiffers(val, entry, pos); !differs {
+			return false, nil
+		}
+	} else if entry.structFieldPos[pos] == nil {
+		return false, nil
+	} else {
+		field := p.discriminantField(val, entry.structFieldPos[pos], false)
+		if !field.IsValid() || field.IsZero() || p.discriminantMatches(p.fieldDiscriminant(field), entry.structValues[pos]) {
+			return false, nil
+		}
+		current = p.fieldDiscriminant(field)
+	}
+	if entry.checkDiscriminant {
+		return false, fmt.Errorf("poly: discriminant %#v of struct %s differs from its registered value %#v",
+			current, entry.structTypes[pos], entry.structValues[pos])
+	}
+	return true, nil
+}
+
+// marshalState carries the settings of one marshal pre-pass and the work it leaves for after encoding
+type marshalState struct {
+	traversal
+	mode Mode
+
+	// rewrites are the changes to make to the encoded document, such as nesting the values of
+	// externally tagged interfaces under their keys
+	rewrites []jsonRewrite
+
+	// stamps are the changes to make to the value, applied only once all of it was walked without error,
+	// so a failing pre-pass leaves the value untouched for a retry. They run in the order they were recorded,
+	// which stores copies back after the changes nested in them
+	stamps []func() error
+
+	// walking holds the pointers whose values are being walked, so a value referring back to itself
+	// is not walked again
+	walking map[walkedPointer]bool
+
+	// restoring records how to undo the stamps into restores, see ClearDiscriminantAfterMarshal
+	restoring bool
+	restores  []func()
+}
+
+// walkedPointer identifies the value behind a pointer, by address and type since a struct
+// and its first field share their address
+type walkedPointer struct {
+	addr uintptr
+	typ  reflect.Type
+}
+
+// enter marks the value behind the non-nil pointer ptr as being walked, and reports false when it already is
+func (s *marshalState) enter(ptr reflect.Value) bool {
+	key := walkedPointer{addr: ptr.Pointer(), typ: ptr.Type()}
+	if s.walking[key] {
+		return false
+	}
+	if s.walking == nil {
+		s.walking = make(map[walkedPointer]bool)
+	}
+	s.walking[key] = true
+	return true
+}
+
+// leave marks the value behind ptr as walked
+func (s *marshalState) leave(ptr reflect.Value) {
+	delete(s.walking, walkedPointer{addr: ptr.Pointer(), typ: ptr.Type()})
+}
+
+// save records the content of the addressable v before a stamp changes it, to be put back by restore
+func (s *marshalState) save(v reflect.Value) {
+	if !s.restoring || !v.CanSet() {
+		return
+	}
+	saved := reflect.New(v.Type()).Elem()
+	saved.Set(v)
+	s.restores = append(s.restores, func() {
+		v.Set(saved)
+	})
+}
+
+// saveMapIndex records the entry of map m at key before a stamp replaces it, to be put back by restore
+func (s *marshalState) saveMapIndex(m reflect.Value, key reflect.Value) {
+	if !s.restoring {
+		return
+	}
+	saved := m.MapIndex(key)
+	s.restores = append(s.restores, func() {
+		m.SetMapIndex(key, saved)
+	})
+}
+
+// restore undoes the stamps recorded by save and saveMapIndex, the last one first
+func (s *marshalState) restore() {
+	for i := len(s.restores) - 1; i >= 0; i-- {
+		s.restores[i]()
+	}
+	s.restores = nil
+}
+
+// beforeMarshalJSONValue recursively processes values before JSON marshaling
+// It sets discriminant field values for interface implementations.
+// The path of state is the JSON field path of val, used to locate it in the encoded document
+func (p *Poly) beforeMarshalJSONValue(state *marshalState, val reflect.Value, depth int) error {
+	if err := p.checkDepth(depth); err != nil {
+		return err
+	}
+	if err := state.checkContext(); err != nil {
+		return err
+	}
+	for val.Kind() == reflect.Ptr {
+		if !val.IsNil() {
+			if !state.enter(val) {
+				// the value refers back to itself, it is walked already
+				return nil
+			}
+			defer state.leave(val)
+		}
+		val = val.Elem()
+	}
+	// if it is interface
+	if val.Kind() == reflect.Interface {
+		iFaceType := val.Type()
+		entry, ok := p.types[iFaceType]
+		if !ok && p.isAny(iFaceType) {
+			// `any` carries no registration, go by the dynamic type of the value instead
+			if entry, ok = p.anyEntry(val); !ok {
+				return p.beforeMarshalJSONValue(state, val.Elem(), depth+1)
+			}
+		}
+		if !ok { // is interface and not found
+			if !state.mode.skipsUnregistered() {
+				return fmt.Errorf("poly: interface type %s not registered", p.typeKey(iFaceType))
+			} else {
+				return nil
+			}
+		}
+		if val.IsNil() {
+			// encoding/json writes null, or drops the field under omitempty
+			return nil
+		}
+		iFaceVal := val
+		val = val.Elem()
+		if val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return nil
+			}
+			if !state.enter(val) {
+				return nil
+			}
+			defer state.leave(val)
+			val = val.Elem()
+		} else {
+			// a struct held by value in the interface is not addressable,
+			// so work on a copy and store it back once it is processed
+			if !iFaceVal.CanSet() {
+				return fmt.Errorf("poly: cannot stamp struct %s held by value in an unaddressable interface", val.Type())
+			}
+			valCopy := reflect.New(val.Type()).Elem()
+			valCopy.Set(val)
+			val = valCopy
+			defer func() {
+				state.stamps = append(state.stamps, func() error {
+					state.save(iFaceVal)
+					iFaceVal.Set(valCopy)
+					return nil
+				})
+			}()
+		}
+		found := false
+		for pos, sType := range entry.structTypes {
+			if sType != val.Type() {
+				continue
+			}
+			if entry.externallyTagged {
+				state.rewrites = append(state.rewrites, jsonRewrite{
+					path:  state.pathCopy(),
+					wrap:  entry.structValues[pos].(string),
+					tuple: entry.tupleTagged,
+				})
+				found = true
+				break
+			}
+			if entry.discriminantMethod != "" {
+				rw, err := p.methodRewrite(val, entry, state.pathCopy())
+				if err != nil {
+					return fmt.Errorf("%w at field path %s", err, joinJSONPath(state.path))
+				}
+				state.rewrites = append(state.rewrites, rw)
+				found = true
+				break
+			}
+			keep, err := p.keepsDiscriminant(val, entry, pos)
+			if err != nil {
+				return fmt.Errorf("%w at field path %s", err, joinJSONPath(state.path))
+			}
+			if !keep {
+				if !entry.omitDiscriminant && !p.stampable(val, entry, pos) {
+					return fmt.Errorf("poly: cannot set discriminant field of struct %s at field path %s",
+						entry.structTypes[pos], joinJSONPath(state.path))
+				}
+				stampVal, stampPos := val, pos
+				state.stamps = append(state.stamps, func() error {
+					state.save(stampVal)
+					return p.stampDiscriminant(stampVal, entry, stampPos, entry.omitDiscriminant)
+				})
+			}
+			if entry.discriminantFirst && entry.structFieldPos[pos] != nil {
+				first := splitJSONPath(entry.discriminantFieldName)[0]
+				state.rewrites = append(state.rewrites, jsonRewrite{path: state.pathCopy(), first: first})
+			}
+			found = true
+			break
+		}
+		if !found && !state.mode.skipsUnregistered() {
+			return fmt.Errorf("poly: interface type %s not found in struct", p.typeKey(entry.fieldType))
+		}
+	}
+	if !val.IsValid() || p.bindPoly(val) || p.marshalsItself(val.Type()) {
+		return nil
+	}
+	if val.Kind() == reflect.Struct {
+		for i := 0; i < val.NumField(); i++ {
+			f := val.Type().Field(i)
+			if !p.isVisible(f) {
+				continue
+			}
+			fieldName, ok := p.jsonFieldName(val.Type(), f)
+			if !ok {
 				continue
 			}
-			fieldName := strings.Split(jsonTag, ",")[0]
-			if fieldName == "" {
+			if p.isNested(f) {
+				state.push(fieldName)
+				err := p.beforeMarshalNested(state, val.Field(i), depth+1)
+				state.pop()
+				if err != nil {
+					return err
+				}
 				continue
 			}
-			err := p.beforeUnmarshalJSONValue(append(prefix, fieldName), val.Field(i), buf, strict)
+			promoted := p.isPromoted(f)
+			if !promoted {
+				state.push(fieldName)
+			}
+			err := p.beforeMarshalJSONValue(state, val.Field(i), depth+1)
+			if !promoted {
+				state.pop()
+			}
 			if err != nil {
 				return err
 			}
 		}
 	} else if val.Kind() == reflect.Slice {
-		l := gjson.GetBytes(buf, strings.Join(append(prefix, "#"), ".")).Int()
-		val.Set(reflect.MakeSlice(val.Type(), int(l), int(l)))
-
 		for i := 0; i < val.Len(); i++ {
-			err := p.beforeUnmarshalJSONValue(append(prefix, strconv.Itoa(i)), val.Index(i), buf, strict)
+			state.push(strconv.Itoa(i))
+			err := p.beforeMarshalJSONValue(state, val.Index(i), depth+1)
+			state.pop()
 			if err != nil {
 				return err
 			}
 		}
+	} else if val.Kind() == reflect.Map {
+		iter := val.MapRange()
+		for iter.Next() {
+			name, err := p.mapKeyName(iter.Key())
+			if err != nil {
+				return err
+			}
+			state.push(name)
+			err = p.beforeMarshalMapEntry(state, val, iter.Key(), iter.Value(), depth+1)
+			state.pop()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BeforeMarshalJSON prepares a value for JSON marshaling by setting discriminant fields
+// Call this before json.Marshal to ensure interface implementations are correctly tagged.
+// Externally tagged interfaces are only wrapped under their keys by Marshal.
+// It is safe to call repeatedly, and on error the value is left unchanged so the call can be retried.
+// Values referring back to themselves through pointers are walked once, encoding/json rejects such cycles.
+// ptr must be a pointer (or a slice or map) so the discriminant fields can be set
+func (p *Poly) BeforeMarshalJSON(ptr any, strict bool) error {
+	return p.BeforeMarshalJSONMode(ptr, modeOf(strict))
+}
+
+// BeforeMarshalJSONMode is BeforeMarshalJSON handling values it cannot type as mode says
+func (p *Poly) BeforeMarshalJSONMode(ptr any, mode Mode) error {
+	return p.beforeMarshalJSON(&marshalState{mode: mode}, ptr)
+}
+
+// BeforeMarshalJSONDefault is BeforeMarshalJSON in DefaultMode
+func (p *Poly) BeforeMarshalJSONDefault(ptr any) error {
+	return p.BeforeMarshalJSONMode(ptr, p.DefaultMode)
+}
+
+// BeforeMarshalJSONContext is BeforeMarshalJSON stopping early with an error once ctx is done
+func (p *Poly) BeforeMarshalJSONContext(ctx context.Context, ptr any, strict bool) error {
+	return p.beforeMarshalJSON(&marshalState{traversal: traversal{ctx: ctx}, mode: modeOf(strict)}, ptr)
+}
+
+// beforeMarshalJSON runs the marshal pre-pass over ptr with state
+func (p *Poly) beforeMarshalJSON(state *marshalState, ptr any) error {
+	val := reflect.ValueOf(ptr)
+	if val.Kind() == reflect.Struct || val.Kind() == reflect.Array {
+		return fmt.Errorf("poly: cannot set discriminant fields of %s passed by value, pass a pointer to it instead", val.Type())
+	}
+	if err := p.beforeMarshalJSONValue(state, val, 0); err != nil {
+		return err
+	}
+	for _, stamp := range state.stamps {
+		if err := stamp(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalState carries the settings of one unmarshal pre-pass and the work it leaves for after decoding
+type unmarshalState struct {
+	traversal
+	mode Mode
+
+	// parents are the nodes holding the values along the path, the last one holding the value visited
+	parents []jsonNode
+
+	// errs are the resolution errors collected under CollectErrors
+	errs []error
+
+	// fixups finish decoding what json.Unmarshal cannot: they store back map entries resolved by the pre-pass,
+	// since json.Unmarshal decodes map values from zero values and loses their concrete types, and they decode
+	// the nested objects of externally tagged interfaces, and they clear interfaces left unresolved. They run
+	// in the order they were recorded, which puts outer values before the values nested in them, and may record
+	// more fixups, such as storing a map entry back after the fixups nested in it
+	fixups []func() error
+
+	// later holds the values of the document decoded by the fixups, which json.Unmarshal decodes as null
+	later rewriteTrie
+}
+
+// beforeUnmarshalJSONValue recursively processes values before JSON unmarshaling
+// It creates appropriate concrete types based on discriminant field values.
+// node is the part of the document at the field path of state, so navigation is incremental
+// instead of rescanning the whole document for every field
+func (p *Poly) beforeUnmarshalJSONValue(state *unmarshalState, val reflect.Value, node jsonNode, depth int) error {
+	if err := p.checkDepth(depth); err != nil {
+		return fmt.Errorf("%w at field path %s", err, joinJSONPath(state.path))
+	}
+	if err := state.checkContext(); err != nil {
+		return err
+	}
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			// json.Unmarshal allocates the pointer for a non-null value,
+			// allocate it ahead so the interface behind it can be resolved
+			if !val.CanSet() || !p.pointsToInterface(val.Type()) || !node.Exists() || node.IsNull() {
+				return nil
+			}
+			val.Set(reflect.New(val.Type().Elem()))
+		}
+		val = val.Elem()
+	}
+
+	if val.Kind() == reflect.Interface {
+		if !val.CanSet() {
+			return nil
+		}
+		iFaceType := val.Type()
+		entry, ok := p.types[iFaceType]
+		if !ok && p.isAny(iFaceType) && p.resolvesAny(node) {
+			entry, ok = p.anyInterface, true
+		}
+		if !ok {
+			// json.Unmarshal decodes `any` into generic values, there is nothing to resolve
+			if !state.mode.skipsUnregistered() && !p.isAny(iFaceType) {
+				return p.unresolved(state, val, fmt.Errorf("poly: interface type %s not registered at field path %s",
+					p.typeKey(iFaceType), joinJSONPath(state.path)))
+			} else {
+				return nil
+			}
+		}
+		if !node.Exists() || node.IsNull() {
+			// json.Unmarshal leaves the interface as it is, or sets it to nil
+			return nil
+		}
+		matched := -1
+		var variant string
+		var wrapper jsonNode
+		if entry.externallyTagged {
+			pos, name, inner := p.externalVariant(entry, node)
+			if pos == -1 {
+				if p.ignoresUnknown(state, entry) {
+					p.leaveUnresolved(state, val)
+					return nil
+				}
+				return p.unresolved(state, val, &ResolveError{Interface: p.typeKey(iFaceType), Path: joinJSONPath(state.path), Raw: node.Raw()})
+			}
+			matched, wrapper, node, variant = pos, node, inner, name
+		} else {
+			discriminantNode := p.discriminantNode(state, entry, node)
+			matched = p.matchObject(entry, discriminantNode)
+			if matched == -1 && p.ignoresUnknown(state, entry) {
+				// fall back to the struct used when the discriminant is absent, if there is one
+				if matched = p.absentMatch(entry); matched == -1 {
+					p.leaveUnresolved(state, val)
+					return nil
+				}
+			}
+			if matched == -1 {
+				return p.unresolved(state, val, &ResolveError{
+					Interface: p.typeKey(iFaceType),
+					Path:      p.discriminantPath(state, entry),
+					Value:     p.discriminantOf(entry, discriminantNode),
+					Raw:       node.Raw(),
+				})
+			}
+		}
+		refVal := val.Elem()
+		if !p.ReuseValues || refVal.Kind() != reflect.Ptr || refVal.IsNil() || refVal.Type().Elem() != entry.structTypes[matched] {
+			refVal = reflect.ValueOf(entry.structCreators[matched]())
+			val.Set(refVal)
+		}
+		if p.OnResolve != nil {
+			p.OnResolve(joinJSONPath(state.path), iFaceType, refVal.Type(), entry.structValues[matched])
+		}
+		if entry.externallyTagged {
+			state.descend(variant, wrapper)
+			defer state.ascend()
+			p.decodeExternal(state, entry, val, node, refVal)
+		}
+		val = refVal
+		if val.Kind() == reflect.Ptr {
+			val = val.Elem()
+		}
+		if entry.stampOnUnmarshal && !entry.externallyTagged {
+			if err := p.stampDiscriminant(val, entry, matched, false); err != nil {
+				return err
+			}
+		}
+	}
+	if !val.IsValid() || p.bindPoly(val) || p.unmarshalsItself(val.Type()) {
+		return nil
+	}
+	if val.Kind() == reflect.Struct {
+		for i := 0; i < val.NumField(); i++ {
+			f := val.Type().Field(i)
+			if !p.isVisible(f) {
+				continue
+			}
+			fieldName, ok := p.jsonFieldName(val.Type(), f)
+			if !ok {
+				continue
+			}
+			if p.isPromoted(f) {
+				if err := p.beforeUnmarshalJSONValue(state, val.Field(i), node, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if p.isNested(f) {
+				if err := p.beforeUnmarshalNested(state, val.Field(i), fieldName, node, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			// the values of fields of plain data are left to json.Unmarshal, whichever member it decodes
+			member := node.Member(fieldName)
+			if p.mayHoldInterface(f.Type, nil) {
+				member = p.member(node, fieldName)
+			}
+			state.descend(fieldName, node)
+			err := p.beforeUnmarshalJSONValue(state, val.Field(i), member, depth+1)
+			state.ascend()
+			if err != nil {
+				return err
+			}
+		}
+	} else if val.Kind() == reflect.Slice && val.CanSet() {
+		if !node.Exists() {
+			// json.Unmarshal leaves the slice as it is
+			return nil
+		}
+		if node.IsNull() {
+			val.Set(reflect.Zero(val.Type()))
+			return nil
+		}
+		if !node.IsArray() {
+			if !p.mayHoldInterface(val.Type().Elem(), nil) {
+				// leave it to json.Unmarshal, e.g. a []byte decodes from a base64 string
+				return nil
+			}
+			return fmt.Errorf("poly: cannot unmarshal json %s into slice %s at field path %s",
+				p.jsonKind(node), val.Type(), joinJSONPath(state.path))
+		}
+		elems := node.Array()
+		if p.MaxSliceLen > 0 && len(elems) > p.MaxSliceLen {
+			return fmt.Errorf("poly: array of %d elements exceeds max slice length %d at field path %s",
+				len(elems), p.MaxSliceLen, joinJSONPath(state.path))
+		}
+		val.Set(reflect.MakeSlice(val.Type(), len(elems), len(elems)))
+
+		for i, elem := range elems {
+			state.descend(strconv.Itoa(i), node)
+			err := p.beforeUnmarshalJSONValue(state, val.Index(i), elem, depth+1)
+			state.ascend()
+			if err != nil {
+				return err
+			}
+		}
+	} else if val.Kind() == reflect.Map && val.CanSet() && node.IsObject() && p.mayHoldInterface(val.Type().Elem(), nil) {
+		if val.IsNil() {
+			val.Set(reflect.MakeMap(val.Type()))
+		}
+		var err error
+		node.ForEach(func(name string, elem jsonNode) bool {
+			err = p.beforeUnmarshalMapEntry(state, val, node, name, elem, depth+1)
+			return err == nil
+		})
+		return err
 	}
 	return nil
 }
 
 // BeforeUnmarshalJSON prepares a value for JSON unmarshaling by creating appropriate concrete types
-// Call this before json.Unmarshal to ensure interface fields get the correct concrete implementations
+// Call this before json.Unmarshal to ensure interface fields get the correct concrete implementations.
+// json.Unmarshal decodes map values from scratch, so interfaces inside maps only keep their
+// concrete types when decoding through Unmarshal. Like json.Unmarshal, it matches the members of
+// fields and discriminants ignoring case, and of several matching members takes the last one
 // ptr: pointer to the value to populate
-// buf: the JSON bytes to parse
+// buf: the JSON bytes to parse, a leading byte order mark is skipped, yet json.Unmarshal rejects it
 func (p *Poly) BeforeUnmarshalJSON(buf []byte, ptr any, strict bool) error {
-	return p.beforeUnmarshalJSONValue(nil, reflect.ValueOf(ptr), buf, strict)
+	return p.BeforeUnmarshalJSONMode(buf, ptr, modeOf(strict))
+}
+
+// BeforeUnmarshalJSONMode is BeforeUnmarshalJSON handling values it cannot type as mode says.
+// Interfaces left nil by ModeLenient are only kept nil when decoding through Unmarshal
+func (p *Poly) BeforeUnmarshalJSONMode(buf []byte, ptr any, mode Mode) error {
+	return p.beforeUnmarshalJSON(&unmarshalState{mode: mode}, buf, ptr)
+}
+
+// BeforeUnmarshalJSONDefault is BeforeUnmarshalJSON in DefaultMode
+func (p *Poly) BeforeUnmarshalJSONDefault(buf []byte, ptr any) error {
+	return p.BeforeUnmarshalJSONMode(buf, ptr, p.DefaultMode)
+}
+
+// BeforeUnmarshalJSONContext is BeforeUnmarshalJSON stopping early with an error once ctx is done
+func (p *Poly) BeforeUnmarshalJSONContext(ctx context.Context, buf []byte, ptr any, strict bool) error {
+	return p.beforeUnmarshalJSON(&unmarshalState{traversal: traversal{ctx: ctx}, mode: modeOf(strict)}, buf, ptr)
+}
+
+// beforeUnmarshalJSON runs the unmarshal pre-pass over ptr for the document buf with state
+func (p *Poly) beforeUnmarshalJSON(state *unmarshalState, buf []byte, ptr any) error {
+	root, err := p.parseJSON(buf)
+	if err != nil {
+		return err
+	}
+	return p.beforeUnmarshalRoot(state, ptr, root)
+}
+
+// beforeUnmarshalRoot runs the unmarshal pre-pass over ptr for the document at root with state,
+// returning the errors collected under CollectErrors too
+func (p *Poly) beforeUnmarshalRoot(state *unmarshalState, ptr any, root jsonNode) error {
+	if err := p.beforeUnmarshalJSONValue(state, reflect.ValueOf(ptr), root, 0); err != nil {
+		return errors.Join(append(state.errs, err)...)
+	}
+	return errors.Join(state.errs...)
+}
+
+// utf8BOM is the byte order mark some producers put before UTF-8 documents
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// trimBOM returns buf without its leading byte order mark, which JSON parsers reject
+func trimBOM(buf []byte) []byte {
+	return bytes.TrimPrefix(buf, utf8BOM)
+}
+
+// jsonKind names the JSON type of node in messages
+func (p *Poly) jsonKind(node jsonNode) string {
+	if node.IsObject() {
+		return "object"
+	} else if node.IsArray() {
+		return "array"
+	} else if node.IsNull() {
+		return "null"
+	} else if _, ok := node.Str(); ok {
+		return "string"
+	} else if raw := node.Raw(); raw == "true" || raw == "false" {
+		return "bool"
+	}
+	return "number"
+}
+
+// ignoresUnknown reports whether an interface of entry whose discriminant matches no struct is left
+// to the default struct or nil instead of failing the pre-pass of state
+func (p *Poly) ignoresUnknown(state *unmarshalState, entry *polyType) bool {
+	return entry.ignoreUnknown || state.mode.skipsUnresolved() && !entry.rejectUnknown
+}
+
+// unresolved fails with err for the interface val, or under CollectErrors records err and leaves val nil
+// so the pre-pass carries on
+func (p *Poly) unresolved(state *unmarshalState, val reflect.Value, err error) error {
+	if !p.CollectErrors {
+		return err
+	}
+	state.errs = append(state.errs, err)
+	p.leaveUnresolved(state, val)
+	return nil
+}
+
+// leaveUnresolved leaves the interface val nil, also after json.Unmarshal decoded the document into it
+func (p *Poly) leaveUnresolved(state *unmarshalState, val reflect.Value) {
+	val.Set(reflect.Zero(val.Type()))
+	state.decodeNull(state.path)
+	state.fixups = append(state.fixups, func() error {
+		val.Set(reflect.Zero(val.Type()))
+		return nil
+	})
+}
+
+// Marshal prepares v with BeforeMarshalJSON and then marshals it with Codec,
+// nesting the values of externally tagged interfaces under their keys.
+// A struct passed by value is prepared and marshaled as an addressable copy
+func (p *Poly) Marshal(v any, strict bool) ([]byte, error) {
+	return p.MarshalMode(v, modeOf(strict))
+}
+
+// MarshalMode is Marshal handling values it cannot type as mode says
+func (p *Poly) MarshalMode(v any, mode Mode) ([]byte, error) {
+	if val := reflect.ValueOf(v); val.Kind() == reflect.Struct || val.Kind() == reflect.Array {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		v = ptr.Interface()
+	}
+	state := &marshalState{mode: mode, restoring: p.ClearDiscriminantAfterMarshal}
+	defer state.restore()
+	if err := p.beforeMarshalJSON(state, v); err != nil {
+		return nil, err
+	}
+	buf, err := p.codec().Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return p.rewrite(buf, state.rewrites)
+}
+
+// MarshalValue marshals v as a value of the interface in DefaultMode, stamping its discriminant, on its own
+// rather than inside an enclosing struct, e.g. to assemble a map[string]json.RawMessage envelope.
+// A nil v marshals to null
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// v: the value held by the interface (e.g., &Circle{Radius: 1})
+func (p *Poly) MarshalValue(iFacePtr any, v any) (json.RawMessage, error) {
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.types[iFaceType]; !ok {
+		return nil, fmt.Errorf("poly: interface type %s not registered", p.typeKey(iFaceType))
+	}
+	iFaceVal := reflect.New(iFaceType)
+	if v != nil {
+		if !reflect.TypeOf(v).Implements(iFaceType) {
+			return nil, fmt.Errorf("poly: %T does not implement interface %s", v, p.typeKey(iFaceType))
+		}
+		iFaceVal.Elem().Set(reflect.ValueOf(v))
+	}
+	return p.MarshalMode(iFaceVal.Interface(), p.DefaultMode)
+}
+
+// MarshalDefault is Marshal in DefaultMode
+func (p *Poly) MarshalDefault(v any) ([]byte, error) {
+	return p.MarshalMode(v, p.DefaultMode)
+}
+
+// MarshalIndent is Marshal with the output indented as json.MarshalIndent does, e.g. for config files
+func (p *Poly) MarshalIndent(v any, prefix, indent string, strict bool) ([]byte, error) {
+	buf, err := p.Marshal(v, strict)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf, prefix, indent); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Unmarshal prepares ptr with BeforeUnmarshalJSON and then unmarshals buf into it with Codec,
+// restoring the entries of maps holding interfaces and decoding externally tagged interfaces afterwards.
+// A leading byte order mark in buf is skipped.
+// ptr may point to a registered interface when the document is the polymorphic object itself
+// (e.g., `var s Shape; p.Unmarshal(buf, &s, true)`), its discriminant is then found at the bare field name
+func (p *Poly) Unmarshal(buf []byte, ptr any, strict bool) error {
+	return p.UnmarshalMode(buf, ptr, modeOf(strict))
+}
+
+// UnmarshalMode is Unmarshal handling values it cannot type as mode says
+func (p *Poly) UnmarshalMode(buf []byte, ptr any, mode Mode) error {
+	buf = trimBOM(buf)
+	root, err := p.parseJSON(buf)
+	if err != nil {
+		return err
+	}
+	if ok, err := p.unmarshalFlat(buf, ptr, root); ok {
+		return err
+	}
+	return p.unmarshal(&unmarshalState{mode: mode}, buf, ptr, root)
+}
+
+// unmarshal is Unmarshal for the document buf parsed into root, running the whole pre-pass with state
+func (p *Poly) unmarshal(state *unmarshalState, buf []byte, ptr any, root jsonNode) error {
+	if err := p.beforeUnmarshalRoot(state, ptr, root); err != nil {
+		return err
+	}
+	if err := p.decode(buf, ptr, &state.later); err != nil {
+		return err
+	}
+	// fixups may record more fixups to run after them
+	for i := 0; i < len(state.fixups); i++ {
+		if err := state.fixups[i](); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalFlat is the fast path of Unmarshal for a document that is a single polymorphic object, decoded into
+// ptr pointing to a nil registered interface. The struct resolved is decoded at once, without walking it, when
+// it cannot hold interfaces and nothing else is asked for, such as OnResolve or stamping on unmarshal.
+// It reports false, having changed nothing, when that does not hold, leaving the document to the pre-pass
+func (p *Poly) unmarshalFlat(buf []byte, ptr any, root jsonNode) (bool, error) {
+	if p.OnResolve != nil || p.ReuseValues || p.MaxSliceLen > 0 {
+		return false, nil
+	}
+	val := reflect.ValueOf(ptr)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Interface || !val.Elem().IsNil() {
+		return false, nil
+	}
+	entry, ok := p.types[val.Elem().Type()]
+	if !ok || entry.externallyTagged || entry.parentLevels != 0 || entry.stampOnUnmarshal || !root.IsObject() {
+		return false, nil
+	}
+	matched := p.matchObject(entry, root)
+	if matched == -1 {
+		return false, nil
+	}
+	value := entry.structCreators[matched]()
+	if p.mayHoldInterface(reflect.TypeOf(value), nil) {
+		return false, nil
+	}
+	val.Elem().Set(reflect.ValueOf(value))
+	return true, p.codec().Unmarshal(buf, ptr)
+}
+
+// UnmarshalDefault is Unmarshal in DefaultMode
+func (p *Poly) UnmarshalDefault(buf []byte, ptr any) error {
+	return p.UnmarshalMode(buf, ptr, p.DefaultMode)
 }
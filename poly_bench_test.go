@@ -0,0 +1,136 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newBenchPoly registers the sample shapes for benchmarks
+func newBenchPoly(b *testing.B) *Poly {
+	poly := &Poly{}
+	require.NoError(b, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(b, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(b, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	return poly
+}
+
+// sliceDocument builds a document holding n shapes in a slice
+func sliceDocument(b *testing.B, poly *Poly, n int) []byte {
+	req := &RequestWithSlice{}
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			req.Shapes = append(req.Shapes, &Circle{Radius: float64(i)})
+		} else {
+			req.Shapes = append(req.Shapes, &Rect{Width: float64(i), Height: float64(i)})
+		}
+	}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(b, err)
+	return buf
+}
+
+// BenchmarkBeforeUnmarshalJSONFlat resolves the single polymorphic field of a small document
+func BenchmarkBeforeUnmarshalJSONFlat(b *testing.B) {
+	poly := newBenchPoly(b)
+	buf, err := poly.Marshal(&Request{Shape: &Rect{Width: 5, Height: 3}}, true)
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &Request{}
+		if err := poly.BeforeUnmarshalJSON(buf, req, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBeforeUnmarshalJSONSlice resolves a slice of a thousand shapes
+func BenchmarkBeforeUnmarshalJSONSlice(b *testing.B) {
+	poly := newBenchPoly(b)
+	buf := sliceDocument(b, poly, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &RequestWithSlice{}
+		if err := poly.BeforeUnmarshalJSON(buf, req, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUnmarshal measures the pre-pass together with the final json.Unmarshal
+func BenchmarkUnmarshal(b *testing.B) {
+	poly := newBenchPoly(b)
+	buf := sliceDocument(b, poly, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &RequestWithSlice{}
+		if err := poly.Unmarshal(buf, req, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// nestedDocument builds a document of groups nested depth levels deep, each holding width shapes
+func nestedDocument(b *testing.B, poly *Poly, depth, width int) []byte {
+	var build func(level int) Shape
+	build = func(level int) Shape {
+		if level == depth {
+			return &Circle{Radius: float64(level)}
+		}
+		group := &Group{}
+		for i := 0; i < width; i++ {
+			group.Shapes = append(group.Shapes, build(level+1))
+		}
+		return group
+	}
+	buf, err := poly.Marshal(&Request{Shape: build(0)}, true)
+	require.NoError(b, err)
+	return buf
+}
+
+// BenchmarkBeforeUnmarshalJSONNested resolves dozens of polymorphic fields spread over nested groups
+func BenchmarkBeforeUnmarshalJSONNested(b *testing.B) {
+	poly := newBenchPoly(b)
+	require.NoError(b, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+	buf := nestedDocument(b, poly, 3, 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &Request{}
+		if err := poly.BeforeUnmarshalJSON(buf, req, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUnmarshalRootInterface compares the fast path of Unmarshal for a document holding a single shape
+// with the pre-pass it skips
+func BenchmarkUnmarshalRootInterface(b *testing.B) {
+	poly := newBenchPoly(b)
+	buf := []byte(`{"type":"rect","width":5,"height":3}`)
+	b.Run("flat", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var shape Shape
+			if err := poly.Unmarshal(buf, &shape, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("prepass", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var shape Shape
+			root, err := poly.parseJSON(buf)
+			if err == nil {
+				err = poly.unmarshal(&unmarshalState{mode: ModeStrict}, buf, &shape, root)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package poly
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzDocument nests shapes in the places the pre-passes walk: fields, slices, nested slices,
+// maps and nested structs
+type FuzzDocument struct {
+	Shape  Shape            `json:"shape"`
+	Shapes []Shape          `json:"shapes"`
+	Grid   [][]Shape        `json:"grid"`
+	ByName map[string]Shape `json:"by_name"`
+	Nested *FuzzDocument    `json:"nested"`
+}
+
+// fuzzInput builds values from the bytes of a fuzz input, reading zeros once they run out,
+// so the same input always builds the same value
+type fuzzInput struct {
+	data []byte
+}
+
+// next returns the next byte of the input, or 0 when there is none left
+func (in *fuzzInput) next() byte {
+	if len(in.data) == 0 {
+		return 0
+	}
+	b := in.data[0]
+	in.data = in.data[1:]
+	return b
+}
+
+// count returns a small number of elements, 0 for none
+func (in *fuzzInput) count() int {
+	return int(in.next() % 4)
+}
+
+// shape builds a shape, nil or nesting at most depth levels of groups
+func (in *fuzzInput) shape(depth int) Shape {
+	switch in.next() % 4 {
+	case 1:
+		return &Circle{Radius: float64(in.next())}
+	case 2:
+		return &Rect{Width: float64(in.next()), Height: float64(in.next())}
+	case 3:
+		if depth > 0 {
+			return &Group{Shapes: in.shapes(depth - 1)}
+		}
+	}
+	return nil
+}
+
+// shapes builds a slice of shapes, nil when empty as JSON null decodes to
+func (in *fuzzInput) shapes(depth int) []Shape {
+	var shapes []Shape
+	for i := in.count(); i > 0; i-- {
+		shapes = append(shapes, in.shape(depth))
+	}
+	return shapes
+}
+
+// document builds a document nesting at most depth levels of documents
+func (in *fuzzInput) document(depth int) *FuzzDocument {
+	doc := &FuzzDocument{Shape: in.shape(2), Shapes: in.shapes(2)}
+	for i := in.count(); i > 0; i-- {
+		doc.Grid = append(doc.Grid, in.shapes(1))
+	}
+	for i := in.count(); i > 0; i-- {
+		if doc.ByName == nil {
+			doc.ByName = make(map[string]Shape)
+		}
+		doc.ByName[strconv.Itoa(i)] = in.shape(1)
+	}
+	if depth > 0 && in.next()%2 == 1 {
+		doc.Nested = in.document(depth - 1)
+	}
+	return doc
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	poly := &Poly{}
+	require.NoError(f, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(f, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(f, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(f, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+
+	f.Add([]byte{})
+	// nested slices of groups
+	f.Add([]byte{3, 3, 3, 2, 1, 7, 2, 9, 8, 3, 2, 1, 1, 0})
+	// a grid, map entries and a nested document
+	f.Add([]byte{1, 5, 2, 1, 4, 3, 2, 2, 1, 1, 2, 3, 1, 3, 1, 2, 1, 3, 3, 1, 1, 1, 3, 4, 1, 6})
+	f.Add([]byte(`{"shape":{"type":"group","shapes":[{"type":"circle","radius":1}]}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := &fuzzInput{data: data}
+		doc := in.document(2)
+		buf, err := poly.Marshal(doc, true)
+		require.NoError(t, err)
+		decoded := &FuzzDocument{}
+		require.NoError(t, poly.Unmarshal(buf, decoded, true), string(buf))
+		require.Equal(t, doc, decoded, string(buf))
+
+		// arbitrary input may fail to decode, but never panics
+		_ = poly.Unmarshal(data, &FuzzDocument{}, true)
+		_ = poly.UnmarshalMode(data, &FuzzDocument{}, ModeLenient)
+	})
+}
@@ -1,8 +1,14 @@
 package poly
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -41,6 +47,15 @@ type NestedRequest struct {
 	} `json:"data"`
 }
 
+// newShapePoly registers Shape with Circle and Rect, the fixture shared by the map and wrapper tests
+func newShapePoly(t *testing.T) *Poly {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	return poly
+}
+
 func TestMarshal(t *testing.T) {
 	req := &Request{
 		Shape: &Circle{Radius: 10},
@@ -182,6 +197,12 @@ func TestRegisterErrors(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "poly: interface type")
 
+	// Test registering an empty or malformed discriminant field name
+	err = poly.RegisterInterface((*Shape)(nil), "")
+	require.EqualError(t, err, "poly: interface github.com/reyoung/poly.Shape needs a discriminantFieldName")
+	err = poly.RegisterInterface((*Shape)(nil), "meta..kind")
+	require.EqualError(t, err, `poly: discriminant field path "meta..kind" of interface github.com/reyoung/poly.Shape has an empty segment`)
+
 	// Test duplicate interface registration
 	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
 	err = poly.RegisterInterface((*Shape)(nil), "type")
@@ -214,6 +235,14 @@ func TestBeforeMarshalErrors(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "poly: interface type")
 	require.Contains(t, err.Error(), "not found in struct")
+
+	// Non-strict marshaling leaves the unregistered struct as is
+	req2.Shape = &Rect{Type: "old", Width: 5, Height: 3}
+	require.NoError(t, poly.BeforeMarshalJSON(req2, false))
+	require.Equal(t, &Rect{Type: "old", Width: 5, Height: 3}, req2.Shape)
+	buf, err := poly.Marshal(req2, false)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"old","width":5,"height":3}}`, string(buf))
 }
 
 func TestBeforeUnmarshalErrors(t *testing.T) {
@@ -255,3 +284,2118 @@ func TestDefaultValue(t *testing.T) {
 	_, ok := req.Shape.(*Circle)
 	require.True(t, ok)
 }
+
+// Meta holds a discriminant nested one level below the variant object
+type Meta struct {
+	Kind string `json:"kind"`
+}
+
+// MetaCircle carries its discriminant inside an embedded-by-value Meta object
+type MetaCircle struct {
+	Meta   Meta    `json:"meta"`
+	Radius float64 `json:"radius"`
+}
+
+// MetaRect carries its discriminant inside a Meta pointer
+type MetaRect struct {
+	Meta   *Meta   `json:"meta"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+func TestNestedDiscriminantPath(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "meta.kind"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*MetaCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*MetaRect)(nil), "rect"))
+
+	// Marshal test, the nil Meta pointer must be allocated to be stamped
+	req := &RequestWithSlice{
+		Shapes: []Shape{
+			&MetaCircle{Radius: 10},
+			&MetaRect{Width: 5, Height: 3},
+		},
+	}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	expected := `{"shapes":[{"meta":{"kind":"circle"},"radius":10},{"meta":{"kind":"rect"},"width":5,"height":3}]}`
+	require.JSONEq(t, expected, string(buf))
+
+	// Unmarshal test
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, &req2))
+	require.Len(t, req2.Shapes, 2)
+	require.Equal(t, &MetaCircle{Meta: Meta{Kind: "circle"}, Radius: 10}, req2.Shapes[0])
+	require.Equal(t, &MetaRect{Meta: &Meta{Kind: "rect"}, Width: 5, Height: 3}, req2.Shapes[1])
+
+	// A struct without the nested discriminant is rejected
+	err = poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "plain")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not found in struct")
+}
+
+func TestRegisterDiscriminantKindMismatch(t *testing.T) {
+	type IntCircle struct {
+		Type   int     `json:"type"`
+		Radius float64 `json:"radius"`
+	}
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	err := poly.RegisterStruct((*Shape)(nil), (*IntCircle)(nil), 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is int, but registered structs of interface")
+	require.Contains(t, err.Error(), "use string")
+
+	// A struct with a consistent discriminant kind is still accepted
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+}
+
+// ShapeHolder is embedded without a tag so its fields are promoted by encoding/json
+type ShapeHolder struct {
+	Inner Shape `json:"inner"`
+}
+
+func TestUnmarshalJSONTagSemantics(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	type TaggedRequest struct {
+		ShapeHolder
+		Ignored  Shape `json:"-"`
+		Dash     Shape `json:"-,"`
+		Plain    Shape `json:",omitempty"`
+		Untagged Shape
+	}
+	buf := []byte(`{"inner":{"type":"rect"},"-":{"type":"circle","radius":1},"Plain":{"type":"rect"},"Untagged":{"type":"circle"}}`)
+	req := &TaggedRequest{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req, true))
+	require.NoError(t, json.Unmarshal(buf, req))
+
+	require.Nil(t, req.Ignored)
+	require.Equal(t, &Rect{Type: "rect"}, req.Inner)
+	require.Equal(t, &Circle{Type: "circle", Radius: 1}, req.Dash)
+	require.Equal(t, &Rect{Type: "rect"}, req.Plain)
+	require.Equal(t, &Circle{Type: "circle"}, req.Untagged)
+}
+
+// hiddenShapes is an unexported struct embedded into RequestWithHidden
+type hiddenShapes struct {
+	Shape  Shape `json:"shape"`
+	secret Shape
+}
+
+// RequestWithHidden has unexported fields in the traversal path
+type RequestWithHidden struct {
+	hiddenShapes
+	private Shape
+	Name    string `json:"name"`
+}
+
+func TestUnexportedFields(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	// Marshal test, unexported interfaces are left untouched
+	req := &RequestWithHidden{Name: "hidden"}
+	req.Shape = &Circle{Radius: 10}
+	req.secret = &Circle{Radius: 1}
+	req.private = &Circle{Radius: 2}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"circle","radius":10},"name":"hidden"}`, string(buf))
+	require.Equal(t, &Circle{Radius: 1}, req.secret)
+	require.Equal(t, &Circle{Radius: 2}, req.private)
+
+	// Unmarshal test, the promoted exported field is still resolved
+	req2 := &RequestWithHidden{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, req2))
+	require.Equal(t, &Circle{Type: "circle", Radius: 10}, req2.Shape)
+	require.Nil(t, req2.secret)
+	require.Nil(t, req2.private)
+}
+
+// Measurable is an interface declaring methods
+type Measurable interface {
+	Area() float64
+}
+
+// Square implements Measurable with a value receiver
+type Square struct {
+	Type string  `json:"type"`
+	Side float64 `json:"side"`
+}
+
+func (s Square) Area() float64 {
+	return s.Side * s.Side
+}
+
+// Disk implements Measurable with a pointer receiver
+type Disk struct {
+	Type   string  `json:"type"`
+	Radius float64 `json:"radius"`
+}
+
+func (d *Disk) Area() float64 {
+	return 3 * d.Radius * d.Radius
+}
+
+func TestMethodInterface(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Square)(nil), "square"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+
+	// Disk only implements Measurable through its pointer
+	var _ Measurable = &Disk{}
+
+	type MeasurableRequest struct {
+		Items []Measurable `json:"items"`
+	}
+
+	// Marshal test, Square is stored by value and Disk by pointer
+	req := &MeasurableRequest{Items: []Measurable{Square{Side: 2}, &Square{Side: 3}, &Disk{Radius: 1}}}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	expected := `{"items":[{"type":"square","side":2},{"type":"square","side":3},{"type":"disk","radius":1}]}`
+	require.JSONEq(t, expected, string(buf))
+	require.Equal(t, Square{Type: "square", Side: 2}, req.Items[0])
+
+	// Unmarshal test, implementations are always created through pointers
+	req2 := &MeasurableRequest{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, req2))
+	require.Len(t, req2.Items, 3)
+	require.Equal(t, &Square{Type: "square", Side: 2}, req2.Items[0])
+	require.Equal(t, &Square{Type: "square", Side: 3}, req2.Items[1])
+	require.Equal(t, &Disk{Type: "disk", Radius: 1}, req2.Items[2])
+	require.Equal(t, 4.0, req2.Items[0].Area())
+	require.Equal(t, 3.0, req2.Items[2].Area())
+}
+
+// QuietCircle tags its discriminant with omitempty so it can be left out of the output
+type QuietCircle struct {
+	Type   string  `json:"type,omitempty"`
+	Radius float64 `json:"radius"`
+}
+
+func TestOmitDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", OmitDiscriminant()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*QuietCircle)(nil), "circle"))
+
+	// Marshal test, even a discriminant set by the caller is cleared
+	req := &Request{Shape: &QuietCircle{Type: "circle", Radius: 10}}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.Equal(t, `{"shape":{"radius":10}}`, string(buf))
+
+	// Unmarshal test, the discriminant still resolves the type when present
+	req2 := &Request{}
+	buf = []byte(`{"shape":{"type":"circle","radius":10}}`)
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, req2))
+	require.Equal(t, &QuietCircle{Type: "circle", Radius: 10}, req2.Shape)
+}
+
+// SelfMarshaled serializes itself, so the Shape inside it must not be traversed
+type SelfMarshaled struct {
+	Shape Shape `json:"shape"`
+}
+
+func (s SelfMarshaled) MarshalJSON() ([]byte, error) {
+	return []byte(`"self"`), nil
+}
+
+func (s *SelfMarshaled) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+func TestMarshalerFieldsAreOpaque(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	type TimedRequest struct {
+		At    time.Time     `json:"at"`
+		Self  SelfMarshaled `json:"self"`
+		Shape Shape         `json:"shape"`
+	}
+
+	// Marshal test, the unregistered Rect inside SelfMarshaled is never visited
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	req := &TimedRequest{At: at, Self: SelfMarshaled{Shape: &Rect{}}, Shape: &Circle{Radius: 10}}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.Equal(t, `{"at":"2024-01-02T03:04:05Z","self":"self","shape":{"type":"circle","radius":10}}`, string(buf))
+	require.Equal(t, &Rect{}, req.Self.Shape)
+
+	// Unmarshal test, the shape still resolves next to the opaque fields
+	req2 := &TimedRequest{}
+	buf = []byte(`{"at":"2024-01-02T03:04:05Z","self":{"shape":{"type":"unknown"}},"shape":{"type":"circle","radius":10}}`)
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, req2))
+	require.True(t, at.Equal(req2.At))
+	require.Nil(t, req2.Self.Shape)
+	require.Equal(t, &Circle{Type: "circle", Radius: 10}, req2.Shape)
+}
+
+// Group is a Shape implementation containing other shapes, so documents can nest arbitrarily deep
+type Group struct {
+	Type   string  `json:"type"`
+	Shapes []Shape `json:"shapes"`
+}
+
+func TestMaxDepth(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	var root Shape = &Circle{Radius: 1}
+	for i := 0; i < 50; i++ {
+		root = &Group{Shapes: []Shape{root}}
+	}
+	req := &Request{Shape: root}
+
+	// The default limit is far above the nesting
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, &Request{}, true))
+
+	poly.MaxDepth = 20
+	err = poly.BeforeMarshalJSON(req, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "poly: max depth 20 exceeded")
+
+	err = poly.BeforeUnmarshalJSON(buf, &Request{}, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "poly: max depth 20 exceeded at field path shape.shapes.0.shapes.0")
+}
+
+func TestMaxSliceLen(t *testing.T) {
+	poly := Poly{MaxSliceLen: 3}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	// the slice is allocated for the elements present, however much padding surrounds them
+	padding := strings.Repeat(" ", 1<<20)
+	buf := []byte(`{"shapes":[` + padding + `{"type":"circle"},{"type":"circle"}` + padding + `]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req, true))
+	require.Len(t, req.Shapes, 2)
+	require.Equal(t, 2, cap(req.Shapes))
+
+	buf = []byte(`{"shapes":[` + strings.Repeat(`{},`, 1000) + `{}]}`)
+	err := poly.Unmarshal(buf, &RequestWithSlice{}, true)
+	require.EqualError(t, err, "poly: array of 1001 elements exceeds max slice length 3 at field path shapes")
+}
+
+func TestPointersToInterface(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	type PointerRequest struct {
+		Shapes []*Shape `json:"shapes"`
+		Double **Shape  `json:"double"`
+		Absent *Shape   `json:"absent"`
+	}
+
+	// Marshal test
+	var circle, rect Shape = &Circle{Radius: 10}, &Rect{Width: 5, Height: 3}
+	rectPtr := &rect
+	req := &PointerRequest{Shapes: []*Shape{&circle, nil, &rect}, Double: &rectPtr}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	expected := `{"shapes":[{"type":"circle","radius":10},null,{"type":"rect","width":5,"height":3}],` +
+		`"double":{"type":"rect","width":5,"height":3},"absent":null}`
+	require.JSONEq(t, expected, string(buf))
+
+	// Unmarshal test, pointers are allocated for non-null values only
+	req2 := &PointerRequest{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, req2))
+	require.Len(t, req2.Shapes, 3)
+	require.Equal(t, &Circle{Type: "circle", Radius: 10}, *req2.Shapes[0])
+	require.Nil(t, req2.Shapes[1])
+	require.Equal(t, &Rect{Type: "rect", Width: 5, Height: 3}, *req2.Shapes[2])
+	require.Equal(t, &Rect{Type: "rect", Width: 5, Height: 3}, **req2.Double)
+	require.Nil(t, req2.Absent)
+}
+
+// Kind is a defined string type used as discriminant
+type Kind string
+
+// KindCircle uses the defined Kind type for its discriminant field
+type KindCircle struct {
+	Type   Kind    `json:"type"`
+	Radius float64 `json:"radius"`
+}
+
+// KindRect uses the defined Kind type for its discriminant field
+type KindRect struct {
+	Type  Kind    `json:"type"`
+	Width float64 `json:"width"`
+}
+
+// Opcode is a Shape implementation with a numeric discriminant
+type Opcode struct {
+	Op   int    `json:"op"`
+	Name string `json:"name"`
+}
+
+func TestDefinedTypeDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*KindCircle)(nil), Kind("circle")))
+	// a plain string is converted to the declared Kind type when stamped
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*KindRect)(nil), "rect"))
+
+	// Marshal test
+	req := &RequestWithSlice{Shapes: []Shape{&KindCircle{Radius: 10}, &KindRect{Width: 5}}}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"type":"circle","radius":10},{"type":"rect","width":5}]}`, string(buf))
+
+	// Unmarshal test
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req2, true))
+	require.NoError(t, json.Unmarshal(buf, req2))
+	require.Equal(t, []Shape{&KindCircle{Type: "circle", Radius: 10}, &KindRect{Type: "rect", Width: 5}}, req2.Shapes)
+}
+
+func TestNumericDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "op"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Opcode)(nil), 7))
+
+	req := &Request{}
+	buf := []byte(`{"shape":{"op":7,"name":"seven"}}`)
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req, true))
+	require.NoError(t, json.Unmarshal(buf, req))
+	require.Equal(t, &Opcode{Op: 7, Name: "seven"}, req.Shape)
+}
+
+func TestStampOnUnmarshal(t *testing.T) {
+	buf := []byte(`{"shape":{"radius":10}}`)
+
+	// By default an absent discriminant stays empty
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), ""))
+	req := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, &Circle{Radius: 10}, req.Shape)
+
+	var stamping Poly
+	require.NoError(t, stamping.RegisterInterface((*Shape)(nil), "type", StampOnUnmarshal()))
+	require.NoError(t, stamping.RegisterStruct((*Shape)(nil), (*Circle)(nil), Kind("")))
+	require.NoError(t, stamping.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, stamping.RegisterStruct((*Shape)(nil), (*KindCircle)(nil), "kind"))
+
+	// The registered value is stamped, converted to the field type
+	req = &Request{}
+	require.NoError(t, stamping.BeforeUnmarshalJSON([]byte(`{"shape":{"type":"kind"}}`), req, true))
+	require.Equal(t, &KindCircle{Type: "kind"}, req.Shape)
+
+	req = &Request{}
+	require.NoError(t, stamping.Unmarshal([]byte(`{"shape":{"type":"rect","width":5}}`), req, true))
+	require.Equal(t, &Rect{Type: "rect", Width: 5}, req.Shape)
+}
+
+// BaseShape carries the discriminant shared by several shapes through embedding
+type BaseShape struct {
+	Type string `json:"type"`
+}
+
+// EmbeddedCircle gets its discriminant field promoted from BaseShape
+type EmbeddedCircle struct {
+	BaseShape
+	Radius float64 `json:"radius"`
+}
+
+func TestEmbeddedDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*EmbeddedCircle)(nil), "circle"))
+
+	req := &Request{Shape: &EmbeddedCircle{Radius: 10}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shape":{"type":"circle","radius":10}}`, string(buf))
+
+	req2 := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, &EmbeddedCircle{BaseShape: BaseShape{Type: "circle"}, Radius: 10}, req2.Shape)
+}
+
+// PtrEmbeddedCircle gets its discriminant field promoted through a pointer to BaseShape
+type PtrEmbeddedCircle struct {
+	*BaseShape
+	Radius float64 `json:"radius"`
+}
+
+func TestNilPointerEmbedDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*PtrEmbeddedCircle)(nil), "circle"))
+
+	// the nil embed is allocated to stamp the discriminant behind it
+	circle := &PtrEmbeddedCircle{Radius: 10}
+	buf, err := poly.Marshal(&Request{Shape: circle}, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shape":{"type":"circle","radius":10}}`, string(buf))
+	require.Equal(t, &BaseShape{Type: "circle"}, circle.BaseShape)
+
+	req := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, &PtrEmbeddedCircle{BaseShape: &BaseShape{Type: "circle"}, Radius: 10}, req.Shape)
+
+	// clearing the discriminant leaves a nil embed nil
+	var omitting Poly
+	require.NoError(t, omitting.RegisterInterface((*Shape)(nil), "type", OmitDiscriminant()))
+	require.NoError(t, omitting.RegisterStruct((*Shape)(nil), (*PtrEmbeddedCircle)(nil), "circle"))
+	circle = &PtrEmbeddedCircle{Radius: 1}
+	buf, err = omitting.Marshal(&Request{Shape: circle}, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shape":{"radius":1}}`, string(buf))
+	require.Nil(t, circle.BaseShape)
+}
+
+func TestAmbiguousDiscriminant(t *testing.T) {
+	type AmbiguousCircle struct {
+		*BaseShape
+		Kind   string  `json:"type"`
+		Radius float64 `json:"radius"`
+	}
+	type AmbiguousRect struct {
+		*BaseShape
+		*KindRect
+	}
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+
+	err := poly.RegisterStruct((*Shape)(nil), (*AmbiguousCircle)(nil), "circle")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is ambiguous, 2 fields are named type")
+
+	err = poly.RegisterStruct((*Shape)(nil), (*AmbiguousRect)(nil), "rect")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is ambiguous, 2 fields are named type")
+}
+
+func TestMarshalByValue(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Square)(nil), "square"))
+
+	type SquareRequest struct {
+		Shape Shape `json:"shape"`
+	}
+	req := SquareRequest{Shape: Square{Side: 2}}
+	err := poly.BeforeMarshalJSON(req, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "passed by value, pass a pointer to it instead")
+
+	// Marshal works on a copy instead, leaving the caller's value untouched
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shape":{"type":"square","side":2}}`, string(buf))
+	require.Equal(t, Square{Side: 2}, req.Shape)
+
+	// Slices are addressable through their elements
+	shapes := []Shape{Square{Side: 3}}
+	require.NoError(t, poly.BeforeMarshalJSON(shapes, true))
+	require.Equal(t, Square{Type: "square", Side: 3}, shapes[0])
+}
+
+// Inventory nests shapes inside slice elements of a nested struct
+type Inventory struct {
+	Data struct {
+		Items []Request `json:"items"`
+	} `json:"data"`
+}
+
+func TestResolveErrorPath(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	buf := []byte(`{"data":{"items":[
+		{"shape":{"type":"circle"}},{"shape":{"type":"circle"}},{"shape":{"type":"circle"}},{"shape":{"type":"hexagon","side":2}}
+	]}}`)
+	err := poly.Unmarshal(buf, &Inventory{}, true)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "github.com/reyoung/poly.Shape", resolveErr.Interface)
+	require.Equal(t, "data.items.3.shape.type", resolveErr.Path)
+	require.Equal(t, "hexagon", resolveErr.Value)
+	require.JSONEq(t, `{"type":"hexagon","side":2}`, resolveErr.Raw)
+}
+
+func TestRegisterStructFunc(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStructFunc((*Shape)(nil), "circle", func() any {
+		return &Circle{Radius: 1}
+	}))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	// Defaults survive for fields absent in the JSON
+	req := &RequestWithSlice{}
+	buf := []byte(`{"shapes":[{"type":"circle"},{"type":"circle","radius":3},{"type":"rect","width":2}]}`)
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&Circle{Type: "circle", Radius: 1},
+		&Circle{Type: "circle", Radius: 3},
+		&Rect{Type: "rect", Width: 2},
+	}, req.Shapes)
+
+	err := poly.RegisterStructFunc((*Shape)(nil), "circle", func() any { return Circle{} })
+	require.ErrorContains(t, err, "poly: struct pointer must be a pointer")
+	err = poly.RegisterStructFunc((*Shape)(nil), "circle", func() any { return nil })
+	require.ErrorContains(t, err, "poly: creator must return a struct pointer, got nil")
+	err = poly.RegisterStructFunc((*Measurable)(nil), "circle", func() any { return &Circle{} })
+	require.ErrorContains(t, err, "poly: interface type mismatch")
+	type CircleWithoutType struct {
+		Radius float64 `json:"radius"`
+	}
+	err = poly.RegisterStructFunc((*Shape)(nil), "circle", func() any { return &CircleWithoutType{} })
+	require.ErrorContains(t, err, "poly: interface type github.com/reyoung/poly.Shape not found in struct")
+}
+
+// TrailingCircle declares its discriminant field last
+type TrailingCircle struct {
+	Radius float64 `json:"radius"`
+	Center struct {
+		X float64 `json:"x"`
+		Y float64 `json:"y"`
+	} `json:"center"`
+	Type string `json:"type"`
+}
+
+func TestDiscriminantFirst(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", DiscriminantFirst()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*TrailingCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	buf, err := poly.Marshal(&Request{Shape: &TrailingCircle{Radius: 2}}, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shape":{"type":"circle","radius":2,"center":{"x":0,"y":0}}}`, string(buf))
+
+	req := &RequestWithSlice{Shapes: []Shape{&Rect{Width: 1}, &TrailingCircle{Radius: 3}}}
+	buf, err = poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"shapes":[{"type":"rect","width":1,"height":0},{"type":"circle","radius":3,"center":{"x":0,"y":0}}]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req.Shapes, req2.Shapes)
+}
+
+// Decorated embeds another Shape, which encoding/json nests under the type name instead of promoting
+type Decorated struct {
+	Type string `json:"type"`
+	Shape
+	Color string `json:"color"`
+}
+
+func TestEmbeddedInterface(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Decorated)(nil), "decorated"))
+
+	req := &Request{Shape: &Decorated{Shape: &Circle{Radius: 1}, Color: "red"}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"decorated","Shape":{"type":"circle","radius":1},"color":"red"}}`, string(buf))
+
+	req2 := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req, req2)
+
+	buf = []byte(`{"shape":{"type":"decorated","Shape":{"type":"hexagon"}}}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &Request{}, true), &resolveErr)
+	require.Equal(t, "shape.Shape.type", resolveErr.Path)
+}
+
+// Figure is a second interface, discriminated by kind
+type Figure interface{}
+
+// DualCircle carries discriminant fields for both Shape and Figure
+type DualCircle struct {
+	Type   string  `json:"type"`
+	Kind   string  `json:"kind"`
+	Radius float64 `json:"radius"`
+}
+
+func TestStructUnderMultipleInterfaces(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterInterface((*Figure)(nil), "kind"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*DualCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Figure)(nil), (*DualCircle)(nil), "round"))
+
+	// each interface stamps its own discriminant field only
+	type Both struct {
+		Shape  Shape  `json:"shape"`
+		Figure Figure `json:"figure"`
+	}
+	both := &Both{Shape: &DualCircle{Radius: 1}, Figure: &DualCircle{Radius: 2}}
+	buf, err := poly.Marshal(both, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"shape":{"type":"circle","kind":"","radius":1},
+		"figure":{"type":"","kind":"round","radius":2}
+	}`, string(buf))
+
+	both2 := &Both{}
+	require.NoError(t, poly.Unmarshal(buf, both2, true))
+	require.Equal(t, both, both2)
+}
+
+// countdownContext is canceled once Err has been checked n times
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestPrePassContext(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	req := &RequestWithSlice{}
+	for i := 0; i < 100000; i++ {
+		req.Shapes = append(req.Shapes, &Circle{Radius: float64(i)})
+	}
+
+	// canceled after a few checks, no shape is stamped
+	err := poly.BeforeMarshalJSONContext(&countdownContext{Context: context.Background(), n: 3}, req, true)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, "", req.Shapes[0].(*Circle).Type)
+	require.Equal(t, "", req.Shapes[len(req.Shapes)-1].(*Circle).Type)
+
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+
+	req2 := &RequestWithSlice{}
+	err = poly.BeforeUnmarshalJSONContext(&countdownContext{Context: context.Background(), n: 3}, buf, req2, true)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotNil(t, req2.Shapes[0])
+	require.Nil(t, req2.Shapes[len(req2.Shapes)-1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, poly.BeforeUnmarshalJSONContext(ctx, buf, &RequestWithSlice{}, true), context.Canceled)
+}
+
+// VersionedCircle is selected by an object discriminant
+type VersionedCircle struct {
+	Type   map[string]any `json:"type"`
+	Radius float64        `json:"radius"`
+}
+
+// VersionedRect is selected by an object discriminant
+type VersionedRect struct {
+	Type  map[string]any `json:"type"`
+	Width float64        `json:"width"`
+}
+
+func TestCompoundDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*VersionedCircle)(nil), map[string]any{"v": 1, "name": "circle"}))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*VersionedRect)(nil), map[string]any{"v": 2, "name": "rect"}))
+
+	req := &RequestWithSlice{Shapes: []Shape{&VersionedCircle{Radius: 1}, &VersionedRect{Width: 2}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[
+		{"type":{"v":1,"name":"circle"},"radius":1},
+		{"type":{"v":2,"name":"rect"},"width":2}
+	]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.IsType(t, &VersionedCircle{}, req2.Shapes[0])
+	require.IsType(t, &VersionedRect{}, req2.Shapes[1])
+	require.Equal(t, 2.0, req2.Shapes[1].(*VersionedRect).Width)
+
+	err = poly.Unmarshal([]byte(`{"shapes":[{"type":{"v":1,"name":"rect"}}]}`), &RequestWithSlice{}, true)
+	require.ErrorContains(t, err, "poly: cannot resolve interface")
+
+	// arrays compare element by element
+	require.True(t, poly.discriminantMatches([]any{1.0, "a"}, []any{1, "a"}))
+	require.False(t, poly.discriminantMatches([]any{1.0}, []any{1, "a"}))
+}
+
+// DottedCircle names its discriminant field with a dot
+type DottedCircle struct {
+	Type   string  `json:"shape.type"`
+	Radius float64 `json:"radius"`
+}
+
+func TestDottedFieldNames(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), `shape\.type`))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*DottedCircle)(nil), "circle"))
+
+	type DottedRequest struct {
+		Shapes map[string][]Shape `json:"a.b"`
+		Shape  Shape              `json:"c*d?"`
+	}
+	req := &DottedRequest{
+		Shapes: map[string][]Shape{"x.y": {&DottedCircle{Radius: 1}}},
+		Shape:  &DottedCircle{Radius: 2},
+	}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"a.b":{"x.y":[{"shape.type":"circle","radius":1}]},
+		"c*d?":{"shape.type":"circle","radius":2}
+	}`, string(buf))
+
+	req2 := &DottedRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req, req2)
+
+	buf = []byte(`{"a.b":{"x.y":[{"shape.type":"square"}]}}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &DottedRequest{}, true), &resolveErr)
+	require.Equal(t, `a\.b.x\.y.0.shape\.type`, resolveErr.Path)
+}
+
+// localShapeInterface registers an interface declared in a function, named like the one in localShapeInterface2
+func localShapeInterface(poly *Poly) error {
+	type LocalShape interface{}
+	return poly.RegisterInterface((*LocalShape)(nil), "type")
+}
+
+// localShapeInterface2 registers another interface declared in a function with the same name
+func localShapeInterface2(poly *Poly) error {
+	type LocalShape interface{}
+	return poly.RegisterInterface((*LocalShape)(nil), "kind")
+}
+
+func TestRegisterUnnamedInterface(t *testing.T) {
+	var poly Poly
+	err := poly.RegisterInterface((*interface{ Area() float64 })(nil), "type")
+	require.ErrorContains(t, err, "poly: cannot register unnamed interface interface { Area() float64 }")
+	err = poly.RegisterInterface((*any)(nil), "type")
+	require.ErrorContains(t, err, "poly: cannot register unnamed interface interface {}")
+
+	// interfaces declared in functions are named, equal names do not collide
+	require.NoError(t, localShapeInterface(&poly))
+	require.NoError(t, localShapeInterface2(&poly))
+	require.Len(t, poly.types, 2)
+}
+
+func TestMultiDimensionalSlices(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	type Grid struct {
+		Items [][]Shape   `json:"items"`
+		Ptr   *[]Shape    `json:"ptr"`
+		Deep  [][][]Shape `json:"deep"`
+	}
+	grid := &Grid{
+		Items: [][]Shape{{&Circle{Radius: 1}}, {}, {&Rect{Width: 2}, &Circle{Radius: 3}}},
+		Ptr:   &[]Shape{&Rect{Height: 4}},
+		Deep:  [][][]Shape{{{&Circle{Radius: 5}}}},
+	}
+	buf, err := poly.Marshal(grid, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"items":[[{"type":"circle","radius":1}],[],[{"type":"rect","width":2,"height":0},{"type":"circle","radius":3}]],
+		"ptr":[{"type":"rect","width":0,"height":4}],
+		"deep":[[[{"type":"circle","radius":5}]]]
+	}`, string(buf))
+
+	grid2 := &Grid{}
+	require.NoError(t, poly.Unmarshal(buf, grid2, true))
+	require.Equal(t, grid, grid2)
+
+	buf = []byte(`{"items":[[],[{"type":"circle"},{"type":"rect"},{"type":"square"}]]}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &Grid{}, true), &resolveErr)
+	require.Equal(t, "items.1.2.type", resolveErr.Path)
+}
+
+func TestOnResolve(t *testing.T) {
+	type resolved struct {
+		path   string
+		iface  reflect.Type
+		chosen reflect.Type
+		value  any
+	}
+	var calls []resolved
+	poly := Poly{OnResolve: func(path string, iface reflect.Type, chosen reflect.Type, value any) {
+		calls = append(calls, resolved{path, iface, chosen, value})
+	}}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	var shapes []Shape
+	buf := []byte(`[{"type":"circle","radius":1},{"type":"rect","width":2},{"type":"circle","radius":3}]`)
+	require.NoError(t, poly.Unmarshal(buf, &shapes, true))
+	require.Len(t, shapes, 3)
+
+	shapeType := reflect.TypeOf((*Shape)(nil)).Elem()
+	require.Equal(t, []resolved{
+		{"0", shapeType, reflect.TypeOf(&Circle{}), "circle"},
+		{"1", shapeType, reflect.TypeOf(&Rect{}), "rect"},
+		{"2", shapeType, reflect.TypeOf(&Circle{}), "circle"},
+	}, calls)
+}
+
+func TestExistingDiscriminant(t *testing.T) {
+	newPoly := func(opts ...InterfaceOption) *Poly {
+		poly := &Poly{}
+		require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", opts...))
+		require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+		return poly
+	}
+	shapes := func() []Shape {
+		return []Shape{&Circle{Type: "disc", Radius: 1}, &Circle{Radius: 2}, &Circle{Type: "circle", Radius: 3}}
+	}
+
+	// by default the registered value overwrites the caller's
+	buf, err := newPoly().Marshal(shapes(), true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"type":"circle","radius":1},{"type":"circle","radius":2},{"type":"circle","radius":3}]`, string(buf))
+
+	buf, err = newPoly(PreserveExistingDiscriminant()).Marshal(shapes(), true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"type":"disc","radius":1},{"type":"circle","radius":2},{"type":"circle","radius":3}]`, string(buf))
+
+	_, err = newPoly(ErrorOnDiscriminantMismatch()).Marshal(shapes(), true)
+	require.EqualError(t, err, `poly: discriminant "disc" of struct poly.Circle differs from its registered value "circle" at field path 0`)
+	buf, err = newPoly(ErrorOnDiscriminantMismatch()).Marshal(shapes()[1:], true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"type":"circle","radius":2},{"type":"circle","radius":3}]`, string(buf))
+
+	_, err = newPoly(PreserveExistingDiscriminant(), ErrorOnDiscriminantMismatch()).Marshal(shapes(), true)
+	require.Error(t, err)
+}
+
+func TestSliceNodeKinds(t *testing.T) {
+	poly := newShapePoly(t)
+
+	// a missing slice is left as it is, null clears it
+	req := &RequestWithSlice{Shapes: []Shape{&Circle{Radius: 1}}}
+	require.NoError(t, poly.Unmarshal([]byte(`{}`), req, true))
+	require.Equal(t, []Shape{&Circle{Radius: 1}}, req.Shapes)
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":null}`), req, true))
+	require.Nil(t, req.Shapes)
+	require.NoError(t, poly.Unmarshal([]byte(`{}`), req, true))
+	require.Nil(t, req.Shapes)
+
+	for raw, kind := range map[string]string{
+		`{"type":"circle"}`: "object",
+		`"circle"`:          "string",
+		`12`:                "number",
+		`true`:              "bool",
+	} {
+		err := poly.Unmarshal([]byte(`{"shapes":`+raw+`}`), &RequestWithSlice{}, true)
+		require.EqualError(t, err, "poly: cannot unmarshal json "+kind+" into slice []poly.Shape at field path shapes")
+	}
+
+	// slices of plain data are left to json.Unmarshal
+	type Blob struct {
+		Data  []byte `json:"data"`
+		Shape Shape  `json:"shape"`
+	}
+	blob := &Blob{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"data":"aGk=","shape":{"type":"rect"}}`), blob, true))
+	require.Equal(t, &Blob{Data: []byte("hi"), Shape: &Rect{Type: "rect"}}, blob)
+}
+
+func TestAbsentDiscriminant(t *testing.T) {
+	buf := []byte(`{"shape":{"radius":10}}`)
+
+	// the struct registered with the zero value is used, whatever the registration order
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), ""))
+	req := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, &Circle{Radius: 10}, req.Shape)
+
+	// without a zero value registration an absent discriminant fails
+	var noDefault Poly
+	require.NoError(t, noDefault.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, noDefault.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, noDefault.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	var resolveErr *ResolveError
+	require.ErrorAs(t, noDefault.Unmarshal(buf, &Request{}, true), &resolveErr)
+	require.Equal(t, "shape.type", resolveErr.Path)
+
+	// a nominated default struct
+	var nominated Poly
+	require.NoError(t, nominated.RegisterInterface((*Shape)(nil), "type", DefaultStruct((*Circle)(nil))))
+	require.NoError(t, nominated.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, nominated.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, nominated.Validate())
+	req = &Request{}
+	require.NoError(t, nominated.Unmarshal(buf, req, true))
+	require.Equal(t, &Circle{Radius: 10}, req.Shape)
+	require.NoError(t, nominated.Unmarshal([]byte(`{"shape":{"type":"rect"}}`), req, true))
+	require.Equal(t, &Rect{Type: "rect"}, req.Shape)
+
+	// requiring the discriminant rejects objects without one even with a zero value registration
+	var required Poly
+	require.NoError(t, required.RegisterInterface((*Shape)(nil), "type", RequireDiscriminant()))
+	require.NoError(t, required.RegisterStruct((*Shape)(nil), (*Circle)(nil), ""))
+	require.ErrorAs(t, required.Unmarshal(buf, &Request{}, true), &resolveErr)
+
+	var unregistered Poly
+	require.NoError(t, unregistered.RegisterInterface((*Shape)(nil), "type", DefaultStruct((*Square)(nil))))
+	require.NoError(t, unregistered.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.EqualError(t, unregistered.Validate(),
+		"poly: default struct poly.Square of interface github.com/reyoung/poly.Shape is not registered")
+
+	err := unregistered.RegisterInterface((*Measurable)(nil), "type", DefaultStruct(Square{}))
+	require.ErrorContains(t, err, "poly: default struct of interface github.com/reyoung/poly.Measurable")
+	err = unregistered.RegisterInterface((*Measurable)(nil), "type", DefaultStruct((*Square)(nil)), RequireDiscriminant())
+	require.EqualError(t, err, "poly: DefaultStruct and RequireDiscriminant cannot be combined")
+}
+
+func TestLargeIntegerDiscriminant(t *testing.T) {
+	type BigCircle struct {
+		Type   int64   `json:"type"`
+		Radius float64 `json:"radius"`
+	}
+	type BigRect struct {
+		Type  int64   `json:"type"`
+		Width float64 `json:"width"`
+	}
+	// both values round to the same float64
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BigCircle)(nil), int64(12345678901234567)))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BigRect)(nil), int64(12345678901234568)))
+	require.NoError(t, poly.Validate())
+
+	buf := []byte(`{"shapes":[{"type":12345678901234568,"width":1},{"type":12345678901234567,"radius":2}]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&BigRect{Type: 12345678901234568, Width: 1},
+		&BigCircle{Type: 12345678901234567, Radius: 2},
+	}, req.Shapes)
+	out, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, string(buf), string(out))
+
+	type NumberCircle struct {
+		Type   json.Number `json:"type"`
+		Radius float64     `json:"radius"`
+	}
+	type NumberRect struct {
+		Type  json.Number `json:"type"`
+		Width float64     `json:"width"`
+	}
+	var numbers Poly
+	require.NoError(t, numbers.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, numbers.RegisterStruct((*Shape)(nil), (*NumberCircle)(nil), json.Number("98765432109876543")))
+	require.NoError(t, numbers.RegisterStruct((*Shape)(nil), (*NumberRect)(nil), json.Number("98765432109876544")))
+	require.NoError(t, numbers.RegisterStruct((*Shape)(nil), (*Rect)(nil), "98765432109876543"))
+	require.NoError(t, numbers.Validate())
+
+	// numbers match json.Number values, strings match strings
+	buf = []byte(`{"shapes":[{"type":98765432109876544},{"type":98765432109876543},{"type":"98765432109876543"}]}`)
+	req = &RequestWithSlice{}
+	require.NoError(t, numbers.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&NumberRect{Type: "98765432109876544"},
+		&NumberCircle{Type: "98765432109876543"},
+		&Rect{Type: "98765432109876543"},
+	}, req.Shapes)
+
+	type HugeCircle struct {
+		Type   *big.Int `json:"type"`
+		Radius float64  `json:"radius"`
+	}
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	var bigs Poly
+	require.NoError(t, bigs.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, bigs.RegisterStruct((*Shape)(nil), (*HugeCircle)(nil), huge))
+	var shape Shape
+	require.NoError(t, bigs.Unmarshal([]byte(`{"type":123456789012345678901234567890,"radius":1}`), &shape, true))
+	require.Equal(t, &HugeCircle{Type: huge, Radius: 1}, shape)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, bigs.Unmarshal([]byte(`{"type":123456789012345678901234567891}`), &shape, true), &resolveErr)
+}
+
+// Container is an interface whose variants hold Shape interfaces
+type Container interface {
+}
+
+// Box holds a single shape
+type Box struct {
+	Kind  string `json:"kind"`
+	Shape Shape  `json:"shape"`
+}
+
+// Crate holds shapes and further containers
+type Crate struct {
+	Kind   string      `json:"kind"`
+	Shapes []Shape     `json:"shapes"`
+	Inner  []Container `json:"inner"`
+}
+
+func TestNestedInterfaces(t *testing.T) {
+	poly := newShapePoly(t)
+	require.NoError(t, poly.RegisterInterface((*Container)(nil), "kind"))
+	require.NoError(t, poly.RegisterStruct((*Container)(nil), (*Box)(nil), "box"))
+	require.NoError(t, poly.RegisterStruct((*Container)(nil), (*Crate)(nil), "crate"))
+
+	type Shipment struct {
+		Containers []Container `json:"containers"`
+	}
+	shipment := &Shipment{Containers: []Container{
+		&Box{Shape: &Circle{Radius: 1}},
+		&Crate{Shapes: []Shape{&Rect{Width: 2}}, Inner: []Container{&Box{Shape: &Rect{Height: 3}}}},
+	}}
+	buf, err := poly.Marshal(shipment, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"containers":[
+		{"kind":"box","shape":{"type":"circle","radius":1}},
+		{"kind":"crate","shapes":[{"type":"rect","width":2,"height":0}],"inner":[
+			{"kind":"box","shape":{"type":"rect","width":0,"height":3}}
+		]}
+	]}`, string(buf))
+
+	shipment2 := &Shipment{}
+	require.NoError(t, poly.Unmarshal(buf, shipment2, true))
+	require.Equal(t, shipment, shipment2)
+
+	// each interface reads its own discriminant at its own depth
+	buf = []byte(`{"containers":[{"kind":"crate","inner":[{"kind":"box","shape":{"kind":"box","type":"square"}}]}]}`)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal(buf, &Shipment{}, true), &resolveErr)
+	require.Equal(t, "containers.0.inner.0.shape.type", resolveErr.Path)
+	require.Equal(t, "square", resolveErr.Value)
+
+	buf = []byte(`{"containers":[{"kind":"crate","inner":[{"type":"circle","shape":{"type":"circle"}}]}]}`)
+	require.ErrorAs(t, poly.Unmarshal(buf, &Shipment{}, true), &resolveErr)
+	require.Equal(t, "containers.0.inner.0.kind", resolveErr.Path)
+}
+
+func TestOmitEmptyInterface(t *testing.T) {
+	poly := newShapePoly(t)
+	type Optional struct {
+		Shape  Shape   `json:"shape,omitempty"`
+		Shapes []Shape `json:"shapes,omitempty"`
+		Plain  Shape   `json:"plain"`
+	}
+
+	// nil interfaces are left to encoding/json in strict mode too
+	buf, err := poly.Marshal(&Optional{}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"plain":null}`, string(buf))
+
+	buf, err = poly.Marshal(&Optional{Shape: &Circle{}, Shapes: []Shape{nil, &Rect{}}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"circle","radius":0},"shapes":[null,{"type":"rect","width":0,"height":0}],"plain":null}`, string(buf))
+
+	// a typed nil pointer is not empty to omitempty, encoding/json writes null
+	buf, err = poly.Marshal(&Optional{Shape: (*Circle)(nil)}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":null,"plain":null}`, string(buf))
+
+	opt := &Optional{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"plain":null}`), opt, true))
+	require.Equal(t, &Optional{}, opt)
+
+	// clearing a nested discriminant does not allocate the object omitempty drops
+	type OptionalMeta struct {
+		Meta   *Meta   `json:"meta,omitempty"`
+		Radius float64 `json:"radius"`
+	}
+	var omitting Poly
+	require.NoError(t, omitting.RegisterInterface((*Shape)(nil), "meta.kind", OmitDiscriminant()))
+	require.NoError(t, omitting.RegisterStruct((*Shape)(nil), (*OptionalMeta)(nil), "circle"))
+	buf, err = omitting.Marshal(&Request{Shape: &OptionalMeta{Radius: 1}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"radius":1}}`, string(buf))
+}
+
+// PtrCircle declares its discriminant as a pointer
+type PtrCircle struct {
+	Type   *string `json:"type,omitempty"`
+	Radius float64 `json:"radius"`
+}
+
+func TestPointerDiscriminantField(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", StampOnUnmarshal()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*PtrCircle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+
+	req := &RequestWithSlice{Shapes: []Shape{&PtrCircle{Radius: 1}, &Rect{Width: 2}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"type":"circle","radius":1},{"type":"rect","width":2,"height":0}]}`, string(buf))
+	circle := "circle"
+	require.Equal(t, &PtrCircle{Type: &circle, Radius: 1}, req.Shapes[0])
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req, req2)
+
+	var check Poly
+	require.NoError(t, check.RegisterInterface((*Shape)(nil), "type", ErrorOnDiscriminantMismatch()))
+	require.NoError(t, check.RegisterStruct((*Shape)(nil), (*PtrCircle)(nil), "circle"))
+	_, err = check.Marshal([]Shape{&PtrCircle{Type: &circle}}, true)
+	require.NoError(t, err)
+	disc := "disc"
+	_, err = check.Marshal([]Shape{&PtrCircle{Type: &disc}}, true)
+	require.ErrorContains(t, err, `poly: discriminant "disc" of struct poly.PtrCircle differs from its registered value "circle"`)
+
+	var omitting Poly
+	require.NoError(t, omitting.RegisterInterface((*Shape)(nil), "type", OmitDiscriminant()))
+	require.NoError(t, omitting.RegisterStruct((*Shape)(nil), (*PtrCircle)(nil), "circle"))
+	buf, err = omitting.Marshal([]Shape{&PtrCircle{Type: &circle, Radius: 3}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"radius":3}]`, string(buf))
+}
+
+func TestSingleStruct(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "", SingleStruct()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*BareCircle)(nil), "circle"))
+	require.NoError(t, poly.Validate())
+	err := poly.RegisterStruct((*Shape)(nil), (*BareRect)(nil), "rect")
+	require.ErrorContains(t, err, "poly: interface github.com/reyoung/poly.Shape takes a single struct, poly.BareCircle is already registered")
+
+	buf, err := poly.Marshal(&Request{Shape: &BareCircle{Radius: 2}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"radius":2}}`, string(buf))
+
+	var resolved any
+	poly.OnResolve = func(path string, iface reflect.Type, chosen reflect.Type, value any) {
+		resolved = value
+	}
+	req := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, &Request{Shape: &BareCircle{Radius: 2}}, req)
+	require.Equal(t, "circle", resolved)
+	req = &Request{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{}}`), req, true))
+	require.Equal(t, &Request{Shape: &BareCircle{}}, req)
+
+	schema, err := poly.JSONSchema((*Shape)(nil))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{
+		"oneOf": []any{map[string]any{"$ref": "#/$defs/BareCircle"}},
+		"$defs": map[string]any{"BareCircle": map[string]any{"type": "object"}},
+	}, schema)
+
+	err = (&Poly{}).RegisterInterface((*Shape)(nil), "type", SingleStruct())
+	require.ErrorContains(t, err, "poly: SingleStruct takes an empty discriminantFieldName")
+}
+
+func TestMarshalIndent(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", ExternallyTagged()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	req := &RequestWithSlice{Shapes: []Shape{&Circle{Radius: 1}}}
+	buf, err := poly.MarshalIndent(req, "", "  ", true)
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "shapes": [
+    {
+      "circle": {
+        "type": "",
+        "radius": 1
+      }
+    }
+  ]
+}`, string(buf))
+
+	_, err = poly.MarshalIndent(&Request{Shape: &Rect{}}, "", "  ", true)
+	require.ErrorContains(t, err, "not found in struct")
+}
+
+func TestBeforeMarshalRetry(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	type Shapes struct {
+		List   []Shape          `json:"list"`
+		ByName map[string]Shape `json:"by_name"`
+	}
+	req := &Shapes{
+		List:   []Shape{&Circle{Radius: 1}, Circle{Radius: 2}, &Rect{}},
+		ByName: map[string]Shape{"a": Circle{Radius: 3}},
+	}
+
+	// a failing pre-pass leaves the value untouched
+	require.ErrorContains(t, poly.BeforeMarshalJSON(req, true), "not found in struct")
+	require.Equal(t, &Shapes{
+		List:   []Shape{&Circle{Radius: 1}, Circle{Radius: 2}, &Rect{}},
+		ByName: map[string]Shape{"a": Circle{Radius: 3}},
+	}, req)
+
+	// and a retry, like repeated calls, stamps it the same way
+	req.List[2] = &Circle{Radius: 4}
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.NoError(t, poly.BeforeMarshalJSON(req, true))
+	buf2, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.Equal(t, string(buf), string(buf2))
+	require.JSONEq(t, `{
+		"list":[{"type":"circle","radius":1},{"type":"circle","radius":2},{"type":"circle","radius":4}],
+		"by_name":{"a":{"type":"circle","radius":3}}
+	}`, string(buf))
+}
+
+// circleImpl is an unexported implementation of Shape created through NewCircleImpl
+type circleImpl struct {
+	Type   string  `json:"type"`
+	Radius float64 `json:"radius"`
+}
+
+// NewCircleImpl returns a circleImpl as a Shape
+func NewCircleImpl(radius float64) Shape {
+	return &circleImpl{Radius: radius}
+}
+
+// kindBase carries the discriminant of the structs embedding it
+type kindBase struct {
+	Kind string `json:"type"`
+}
+
+// embeddedRect gets its discriminant field from an unexported embedded struct
+type embeddedRect struct {
+	kindBase
+	Width float64 `json:"width"`
+}
+
+// ptrKindRect gets its discriminant field through an embedded pointer to an unexported struct
+type ptrKindRect struct {
+	*kindBase
+	Width float64 `json:"width"`
+}
+
+func TestUnexportedStructs(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*circleImpl)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*embeddedRect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+
+	req := &RequestWithSlice{Shapes: []Shape{NewCircleImpl(1), circleImpl{Radius: 2}, &embeddedRect{Width: 3}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[
+		{"type":"circle","radius":1},
+		{"type":"circle","radius":2},
+		{"type":"rect","width":3}
+	]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, []Shape{
+		&circleImpl{Type: "circle", Radius: 1},
+		&circleImpl{Type: "circle", Radius: 2},
+		&embeddedRect{kindBase: kindBase{Kind: "rect"}, Width: 3},
+	}, req2.Shapes)
+
+	// neither reflection nor encoding/json can allocate a nil embedded pointer to an unexported struct
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*ptrKindRect)(nil), "ptr_rect"))
+	req = &RequestWithSlice{Shapes: []Shape{&circleImpl{}, &ptrKindRect{}}}
+	_, err = poly.Marshal(req, true)
+	require.EqualError(t, err, "poly: cannot set discriminant field of struct poly.ptrKindRect at field path shapes.1")
+	require.Equal(t, &circleImpl{}, req.Shapes[0])
+	buf, err = poly.Marshal(&RequestWithSlice{Shapes: []Shape{&ptrKindRect{kindBase: &kindBase{}}}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"type":"ptr_rect","width":0}]}`, string(buf))
+}
+
+// UntaggedCircle carries its discriminant in a field without a json tag
+type UntaggedCircle struct {
+	Kind   string
+	Radius float64 `json:"radius"`
+}
+
+// TaggedKindRect carries both a tagged and an untagged field named Kind
+type TaggedKindRect struct {
+	Kind  string
+	Shape string  `json:"Kind"`
+	Width float64 `json:"width"`
+}
+
+func TestUntaggedDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "Kind"))
+	err := poly.RegisterStruct((*Shape)(nil), (*UntaggedCircle)(nil), "circle")
+	require.ErrorContains(t, err, "not found in struct")
+
+	poly = Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "Kind", UntaggedDiscriminant()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*UntaggedCircle)(nil), "circle"))
+	// the tagged field wins over the untagged one
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*TaggedKindRect)(nil), "rect"))
+
+	req := &RequestWithSlice{Shapes: []Shape{&UntaggedCircle{Radius: 1}, &TaggedKindRect{Width: 2}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"Kind":"circle","radius":1},{"Kind":"rect","width":2}]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req.Shapes, req2.Shapes)
+}
+
+func TestMissingDiscriminantFieldHint(t *testing.T) {
+	type KindCircle struct {
+		Kind   string  `json:"kind"`
+		Radius float64 `json:"radius"`
+		hidden string
+	}
+	type Empty struct{}
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	err := poly.RegisterStruct((*Shape)(nil), (*KindCircle)(nil), "circle")
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Shape not found in struct poly.KindCircle, "+
+		"json fields of poly.KindCircle are kind, radius")
+	err = poly.RegisterStruct((*Shape)(nil), (*Empty)(nil), "empty")
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Shape not found in struct poly.Empty, poly.Empty has no json fields")
+
+	// nested paths list the fields where the path goes wrong
+	poly = Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "meta.type"))
+	err = poly.RegisterStruct((*Shape)(nil), (*MetaCircle)(nil), "circle")
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Shape not found in struct poly.MetaCircle, "+
+		"json fields of poly.Meta are kind")
+	err = poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle")
+	require.ErrorContains(t, err, "json fields of poly.Circle are radius, type")
+}
+
+func TestReuseValues(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	pooled := &Circle{Radius: 1}
+	req := &RequestWithSlice{Shapes: []Shape{nil}}
+	single := &Request{Shape: pooled}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"circle","radius":2}}`), single, true))
+	require.NotSame(t, pooled, single.Shape)
+	require.Equal(t, &Circle{Radius: 1}, pooled)
+
+	poly.ReuseValues = true
+	single.Shape = pooled
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"circle","radius":2}}`), single, true))
+	require.Same(t, pooled, single.Shape)
+	require.Equal(t, &Circle{Type: "circle", Radius: 2}, pooled)
+
+	// fields absent in the JSON keep their values
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"circle"}}`), single, true))
+	require.Same(t, pooled, single.Shape)
+	require.Equal(t, &Circle{Type: "circle", Radius: 2}, pooled)
+
+	// values of another type are replaced
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"rect","width":3}}`), single, true))
+	require.Equal(t, &Rect{Type: "rect", Width: 3}, single.Shape)
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":[{"type":"rect"}]}`), req, true))
+	require.Equal(t, &Rect{Type: "rect"}, req.Shapes[0])
+}
+
+// OpLow is the instruction of opcodes 0 to 99
+type OpLow struct {
+	Op  int `json:"op"`
+	Arg int `json:"arg"`
+}
+
+// OpHigh is the instruction of opcodes 100 to 199
+type OpHigh struct {
+	Op   int    `json:"op"`
+	Name string `json:"name"`
+}
+
+// OpHalt is the instruction of a single opcode
+type OpHalt struct {
+	Op int `json:"op"`
+}
+
+// opRange returns a predicate accepting the opcodes from lo to hi
+func opRange(lo, hi float64) func(any) bool {
+	return func(v any) bool {
+		op, ok := v.(float64)
+		return ok && op >= lo && op <= hi
+	}
+}
+
+func TestRegisterStructMatch(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "op"))
+	// registered first, 42 resolves to OpHalt although the low range accepts it too
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*OpHalt)(nil), 42))
+	require.NoError(t, poly.RegisterStructMatch((*Shape)(nil), (*OpLow)(nil), opRange(0, 99), 1))
+	require.NoError(t, poly.RegisterStructMatch((*Shape)(nil), (*OpHigh)(nil), opRange(100, 199), 100))
+	// registered last, 150 resolves to OpHigh
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*OpHalt)(nil), 150))
+	require.NoError(t, poly.Validate())
+
+	buf := []byte(`{"shapes":[{"op":7,"arg":1},{"op":42},{"op":99},{"op":100,"name":"a"},{"op":150},{"op":199}]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&OpLow{Op: 7, Arg: 1}, &OpHalt{Op: 42}, &OpLow{Op: 99},
+		&OpHigh{Op: 100, Name: "a"}, &OpHigh{Op: 150}, &OpHigh{Op: 199},
+	}, req.Shapes)
+
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"shapes":[{"op":200}]}`), req, true), &resolveErr)
+	require.Equal(t, 200.0, resolveErr.Value)
+
+	// the marshal value is stamped
+	buf, err := poly.Marshal(&RequestWithSlice{Shapes: []Shape{&OpLow{Arg: 2}, &OpHigh{Name: "b"}}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"op":1,"arg":2},{"op":100,"name":"b"}]}`, string(buf))
+
+	err = poly.RegisterStructMatch((*Shape)(nil), (*OpLow)(nil), nil, 1)
+	require.EqualError(t, err, "poly: match must not be nil")
+	_, err = poly.JSONSchema((*Shape)(nil))
+	require.ErrorContains(t, err, "cannot describe")
+}
+
+func TestAnonymousStructFields(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	// ShapeHolder embedded with a tag is nested like the inline struct types
+	type AnonymousRequest struct {
+		Inner struct {
+			Shape Shape `json:"shape"`
+			Outer struct {
+				Shapes []Shape `json:"shapes"`
+			} `json:"outer"`
+		} `json:"inner"`
+		ShapeHolder `json:"holder"`
+	}
+	req := &AnonymousRequest{}
+	req.Inner.Shape = &Circle{Radius: 1}
+	req.Inner.Outer.Shapes = []Shape{&Circle{Radius: 2}}
+	req.ShapeHolder.Inner = &Circle{Radius: 3}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"inner":{"shape":{"type":"circle","radius":1},"outer":{"shapes":[{"type":"circle","radius":2}]}},
+		"holder":{"inner":{"type":"circle","radius":3}}
+	}`, string(buf))
+
+	req2 := &AnonymousRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req, req2)
+
+	var resolveErr *ResolveError
+	err = poly.Unmarshal([]byte(`{"inner":{"shape":{"type":"square"}}}`), &AnonymousRequest{}, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "inner.shape.type", resolveErr.Path)
+	err = poly.Unmarshal([]byte(`{"inner":{"outer":{"shapes":[{"type":"square"}]}}}`), &AnonymousRequest{}, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "inner.outer.shapes.0.type", resolveErr.Path)
+	err = poly.Unmarshal([]byte(`{"holder":{"inner":{"type":"square"}}}`), &AnonymousRequest{}, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "holder.inner.type", resolveErr.Path)
+}
+
+func TestCollectErrors(t *testing.T) {
+	poly := Poly{CollectErrors: true}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	buf := []byte(`{"shapes":[{"type":"square"},{"type":"circle","radius":1},{"type":"oval"},{"type":"square"}]}`)
+	req := &RequestWithSlice{}
+	err := poly.BeforeUnmarshalJSON(buf, req, true)
+	require.Error(t, err)
+	var paths []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var resolveErr *ResolveError
+		require.ErrorAs(t, err, &resolveErr)
+		paths = append(paths, resolveErr.Path)
+	}
+	require.Equal(t, []string{"shapes.0.type", "shapes.2.type", "shapes.3.type"}, paths)
+	// everything else is resolved
+	require.Equal(t, []Shape{nil, &Circle{}, nil, nil}, req.Shapes)
+
+	err = poly.Unmarshal([]byte(`{"shape":{"type":"oval"},"other":{},"more":{}}`), &struct {
+		Shape Shape        `json:"shape"`
+		Other Unregistered `json:"other"`
+		More  Unregistered `json:"more"`
+	}{}, true)
+	require.EqualError(t, err, `poly: cannot resolve interface github.com/reyoung/poly.Shape type by field path shape.type, value "oval", raw json {"type":"oval"}
+poly: interface type github.com/reyoung/poly.Unregistered not registered at field path other
+poly: interface type github.com/reyoung/poly.Unregistered not registered at field path more`)
+
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":[{"type":"circle"}]}`), req, true))
+}
+
+func TestNormalizeDiscriminant(t *testing.T) {
+	normalize := func(v any) any {
+		if s, ok := v.(string); ok {
+			return strings.ToLower(strings.TrimSpace(s))
+		}
+		return v
+	}
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type", NormalizeDiscriminant(normalize)))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "Circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+
+	buf := []byte(`{"shapes":[{"type":"Circle "},{"type":" CIRCLE"},{"type":"circle"},{"type":"\tRect\n"}]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&Circle{Type: "Circle "}, &Circle{Type: " CIRCLE"}, &Circle{Type: "circle"}, &Rect{Type: "\tRect\n"},
+	}, req.Shapes)
+
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"shapes":[{"type":" oval "}]}`), req, true), &resolveErr)
+	require.Equal(t, " oval ", resolveErr.Value)
+
+	// the registered value is still stamped as is
+	buf, err := poly.Marshal(&Request{Shape: &Circle{}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"Circle","radius":0}}`, string(buf))
+
+	// values equal once normalized are reported
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Square)(nil), " RECT"))
+	require.ErrorContains(t, poly.Validate(), `poly: discriminant value " RECT" of interface github.com/reyoung/poly.Shape is registered for both poly.Rect and poly.Square`)
+
+	err = (&Poly{}).RegisterInterface((*Shape)(nil), "type", NormalizeDiscriminant(normalize), ExternallyTagged())
+	require.ErrorContains(t, err, "cannot be combined")
+}
+
+// ShapeAlias is another name for Shape, as generated code declares
+type ShapeAlias = Shape
+
+// AliasRequest declares its interface fields through ShapeAlias
+type AliasRequest struct {
+	Shape  ShapeAlias            `json:"shape"`
+	Shapes []ShapeAlias          `json:"shapes"`
+	ByName map[string]ShapeAlias `json:"by_name"`
+}
+
+func TestTypeAlias(t *testing.T) {
+	// an alias denotes the very same type, so the registry is keyed the same through either name
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*ShapeAlias)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*ShapeAlias)(nil), (*Rect)(nil), "rect"))
+	require.ErrorContains(t, poly.RegisterInterface((*Shape)(nil), "type"), "poly: interface already registered")
+
+	req := &AliasRequest{
+		Shape:  &Circle{Radius: 1},
+		Shapes: []ShapeAlias{&Rect{Width: 2}},
+		ByName: map[string]ShapeAlias{"a": &Circle{Radius: 3}},
+	}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"shape":{"type":"circle","radius":1},
+		"shapes":[{"type":"rect","width":2,"height":0}],
+		"by_name":{"a":{"type":"circle","radius":3}}
+	}`, string(buf))
+
+	req2 := &AliasRequest{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, req, req2)
+}
+
+func TestRootInterface(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+
+	// the document is the polymorphic object itself
+	var shape Shape
+	require.NoError(t, poly.Unmarshal([]byte(`{"type":"circle","radius":10}`), &shape, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 10}, shape)
+
+	shape = &Group{Shapes: []Shape{&Circle{Radius: 1}}}
+	buf, err := poly.Marshal(&shape, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"group","shapes":[{"type":"circle","radius":1}]}`, string(buf))
+
+	var decoded Shape
+	require.NoError(t, poly.Unmarshal(buf, &decoded, true))
+	require.Equal(t, shape, decoded)
+
+	// paths start at the root, with the bare discriminant field name for the root itself
+	var paths []string
+	poly.OnResolve = func(path string, _ reflect.Type, _ reflect.Type, _ any) {
+		paths = append(paths, path)
+	}
+	require.NoError(t, poly.Unmarshal(buf, &decoded, true))
+	require.Equal(t, []string{"", "shapes.0"}, paths)
+
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"type":"oval"}`), &decoded, true), &resolveErr)
+	require.Equal(t, "type", resolveErr.Path)
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"type":"group","shapes":[{"type":"oval"}]}`), &decoded, true), &resolveErr)
+	require.Equal(t, "shapes.0.type", resolveErr.Path)
+}
+
+func TestUnmarshalFlat(t *testing.T) {
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+	flat := func(buf string, ptr any) bool {
+		root, err := poly.parseJSON([]byte(buf))
+		require.NoError(t, err)
+		ok, err := poly.unmarshalFlat([]byte(buf), ptr, root)
+		require.NoError(t, err)
+		return ok
+	}
+
+	var shape Shape
+	require.True(t, flat(`{"type":"circle","radius":10}`, &shape))
+	require.Equal(t, &Circle{Type: "circle", Radius: 10}, shape)
+
+	// the pre-pass takes over where the fast path cannot tell the outcome, changing nothing before
+	shape = nil
+	require.False(t, flat(`{"type":"group","shapes":[]}`, &shape))
+	require.False(t, flat(`{"type":"oval"}`, &shape))
+	require.False(t, flat(`[]`, &shape))
+	require.False(t, flat(`{"type":"circle"}`, &Request{}))
+	require.Nil(t, shape)
+	shape = &Circle{}
+	require.False(t, flat(`{"type":"circle"}`, &shape))
+
+	stamping := &Poly{}
+	require.NoError(t, stamping.RegisterInterface((*Shape)(nil), "type", StampOnUnmarshal(), DefaultStruct((*Circle)(nil))))
+	require.NoError(t, stamping.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	var circle Shape
+	require.NoError(t, stamping.Unmarshal([]byte(`{"radius":1}`), &circle, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 1}, circle)
+
+	// both paths decode alike
+	for _, buf := range []string{`{"type":"circle","radius":1}`, `{"radius":2,"type":"circle"}`, `{"type":"circle","radius":"x"}`} {
+		var viaFlat, viaPrePass Shape
+		flatErr := poly.Unmarshal([]byte(buf), &viaFlat, true)
+		root, err := poly.parseJSON([]byte(buf))
+		require.NoError(t, err)
+		prePassErr := poly.unmarshal(&unmarshalState{mode: ModeStrict}, []byte(buf), &viaPrePass, root)
+		require.Equal(t, prePassErr, flatErr, buf)
+		require.Equal(t, viaPrePass, viaFlat, buf)
+	}
+}
+
+// Proxy is a Shape delegating to the Shape it holds, which may lead back to itself
+type Proxy struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+	Inner Shape  `json:"inner"`
+}
+
+func TestSelfReferentialValues(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Proxy)(nil), "proxy"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	// the pre-pass stops where a value refers back to itself, encoding/json then reports the cycle
+	self := &Proxy{Label: "self"}
+	self.Inner = self
+	require.NoError(t, poly.BeforeMarshalJSON(&Request{Shape: self}, true))
+	require.Equal(t, "proxy", self.Type)
+	_, err := poly.Marshal(&Request{Shape: self}, true)
+	require.ErrorContains(t, err, "encountered a cycle")
+
+	a, b := &Proxy{Label: "a"}, &Proxy{Label: "b"}
+	a.Inner, b.Inner = b, a
+	require.NoError(t, poly.BeforeMarshalJSON(a, true))
+	require.Equal(t, "proxy", b.Type)
+
+	// a value shared without a cycle is processed wherever it appears
+	circle := &Circle{Radius: 1}
+	buf, err := poly.Marshal(&RequestWithSlice{Shapes: []Shape{circle, &Proxy{Inner: circle}}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[
+		{"type":"circle","radius":1},
+		{"type":"proxy","label":"","inner":{"type":"circle","radius":1}}
+	]}`, string(buf))
+}
+
+// ShapeCode is an enum discriminant encoding/json writes by name through encoding.TextMarshaler
+type ShapeCode int
+
+const (
+	ShapeCodeCircle ShapeCode = iota + 1
+	ShapeCodeRect
+)
+
+var shapeCodeNames = map[ShapeCode]string{ShapeCodeCircle: "circle", ShapeCodeRect: "rect"}
+
+func (c ShapeCode) MarshalText() ([]byte, error) {
+	name, ok := shapeCodeNames[c]
+	if !ok {
+		return nil, fmt.Errorf("unknown shape code %d", int(c))
+	}
+	return []byte(name), nil
+}
+
+func (c *ShapeCode) UnmarshalText(text []byte) error {
+	for code, name := range shapeCodeNames {
+		if name == string(text) {
+			*c = code
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown shape code %q", text)
+}
+
+// CodeCircle has an enum discriminant field
+type CodeCircle struct {
+	Code   ShapeCode `json:"code"`
+	Radius float64   `json:"radius"`
+}
+
+// CodeRect has an enum discriminant field
+type CodeRect struct {
+	Code  ShapeCode `json:"code"`
+	Width float64   `json:"width"`
+}
+
+func TestTextMarshalerDiscriminant(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "code"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*CodeCircle)(nil), ShapeCodeCircle))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*CodeRect)(nil), ShapeCodeRect))
+	require.NoError(t, poly.Validate())
+
+	req := &RequestWithSlice{Shapes: []Shape{&CodeCircle{Radius: 1}, &CodeRect{Width: 2}}}
+	buf, err := poly.Marshal(req, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"code":"circle","radius":1},{"code":"rect","width":2}]}`, string(buf))
+
+	req2 := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, []Shape{&CodeCircle{Code: ShapeCodeCircle, Radius: 1}, &CodeRect{Code: ShapeCodeRect, Width: 2}}, req2.Shapes)
+
+	// the enum is written as text, so its number is no discriminant
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"shapes":[{"code":1}]}`), req2, true), &resolveErr)
+	require.Equal(t, 1.0, resolveErr.Value)
+}
+
+func TestSliceOfStructsWithNilInterfaces(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	for _, strict := range []bool{true, false} {
+		reqs := []Request{{Shape: &Circle{Radius: 1}}, {}, {Shape: &Rect{Width: 2}}, {}}
+		buf, err := poly.Marshal(reqs, strict)
+		require.NoError(t, err)
+		require.JSONEq(t, `[
+			{"shape":{"type":"circle","radius":1}},
+			{"shape":null},
+			{"shape":{"type":"rect","width":2,"height":0}},
+			{"shape":null}
+		]`, string(buf))
+
+		var decoded []Request
+		require.NoError(t, poly.Unmarshal(buf, &decoded, strict))
+		require.Equal(t, []Request{
+			{Shape: &Circle{Type: "circle", Radius: 1}}, {}, {Shape: &Rect{Type: "rect", Width: 2}}, {},
+		}, decoded)
+
+		// elements leaving the interface out entirely decode the same as null ones
+		decoded = nil
+		require.NoError(t, poly.Unmarshal([]byte(`[{},{"shape":{"type":"circle"}},{}]`), &decoded, strict))
+		require.Equal(t, []Request{{}, {Shape: &Circle{Type: "circle"}}, {}}, decoded)
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	areaType := reflect.TypeOf((*interface{ Area() float64 })(nil)).Elem()
+	perimeterType := reflect.TypeOf((*interface{ Perimeter() float64 })(nil)).Elem()
+	poly := Poly{KeyFunc: func(t reflect.Type) string {
+		if t.Name() == "" {
+			return t.String()
+		}
+		return t.PkgPath() + "." + t.Name()
+	}}
+	require.NoError(t, poly.RegisterInterfaceType(areaType, "type"))
+	require.NoError(t, poly.RegisterInterfaceType(perimeterType, "type"))
+	require.NoError(t, poly.RegisterStructType(areaType, reflect.TypeOf(Disk{}), "disk"))
+	require.ErrorContains(t, poly.RegisterInterface((*any)(nil), "type"), "see ResolveAny")
+
+	// both unnamed interfaces are kept apart and reported by their KeyFunc names
+	registered := poly.Registered()
+	require.Len(t, registered, 2)
+	require.Equal(t, "interface { Area() float64 }", registered[0].Name)
+	require.Len(t, registered[0].Structs, 1)
+	require.Equal(t, "interface { Perimeter() float64 }", registered[1].Name)
+	require.Empty(t, registered[1].Structs)
+	require.EqualError(t, poly.Validate(), "poly: interface interface { Perimeter() float64 } has no registered structs")
+
+	var holder struct {
+		Area interface{ Area() float64 } `json:"area"`
+	}
+	require.NoError(t, poly.Unmarshal([]byte(`{"area":{"type":"disk","radius":1}}`), &holder, true))
+	require.Equal(t, &Disk{Type: "disk", Radius: 1}, holder.Area)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"area":{"type":"oval"}}`), &holder, true), &resolveErr)
+	require.Equal(t, "interface { Area() float64 }", resolveErr.Interface)
+}
+
+func TestNilStructPointerHoldingInterfaces(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	// the pre-pass allocates the nil pointer to resolve the interfaces in the struct behind it
+	var doc struct {
+		Inner *RequestWithSlice `json:"inner"`
+	}
+	require.NoError(t, poly.Unmarshal([]byte(`{"inner":{"shapes":[{"type":"circle","radius":1}]}}`), &doc, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle", Radius: 1}}, doc.Inner.Shapes)
+
+	doc.Inner = nil
+	require.NoError(t, poly.Unmarshal([]byte(`{"inner":null}`), &doc, true))
+	require.Nil(t, doc.Inner)
+}
+
+// ShapeData holds a shape behind the pointer of DataRequest
+type ShapeData struct {
+	Shape Shape `json:"shape"`
+}
+
+// DataRequest holds its shape in a struct behind a pointer
+type DataRequest struct {
+	Data *ShapeData `json:"data"`
+}
+
+func TestNilDataPointer(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	buf := []byte(`{"data":{"shape":{"type":"circle","radius":1}}}`)
+	req := &DataRequest{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req, true))
+	require.NotNil(t, req.Data)
+	require.IsType(t, &Circle{}, req.Data.Shape)
+	require.NoError(t, json.Unmarshal(buf, req))
+	require.Equal(t, &Circle{Type: "circle", Radius: 1}, req.Data.Shape)
+
+	// the pointer passed in may be nil itself
+	var data *ShapeData
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"circle","radius":2}}`), &data, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 2}, data.Shape)
+}
+
+func TestMarshalValue(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Group)(nil), "group"))
+
+	envelope := map[string]json.RawMessage{}
+	raw, err := poly.MarshalValue((*Shape)(nil), &Circle{Radius: 1})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"circle","radius":1}`, string(raw))
+	envelope["shape"] = raw
+
+	raw, err = poly.MarshalValue((*Shape)(nil), &Group{Shapes: []Shape{&Circle{Radius: 2}}})
+	require.NoError(t, err)
+	envelope["group"] = raw
+
+	raw, err = poly.MarshalValue((*Shape)(nil), nil)
+	require.NoError(t, err)
+	envelope["none"] = raw
+
+	buf, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"type":"circle","radius":1},
+		"group":{"type":"group","shapes":[{"type":"circle","radius":2}]},"none":null}`, string(buf))
+
+	_, err = poly.MarshalValue((*Shape)(nil), &Rect{})
+	require.Error(t, err)
+	_, err = poly.MarshalValue((*Unregistered)(nil), &Circle{})
+	require.ErrorContains(t, err, "poly: interface type github.com/reyoung/poly.Unregistered not registered")
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	_, err = poly.MarshalValue((*Measurable)(nil), 1)
+	require.ErrorContains(t, err, "poly: int does not implement interface github.com/reyoung/poly.Measurable")
+
+	// like MarshalDefault, it marshals unregistered structs without a discriminant in DefaultMode
+	poly.DefaultMode = ModeSkipUnregistered
+	raw, err = poly.MarshalValue((*Shape)(nil), &Rect{Width: 1})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"","width":1,"height":0}`, string(raw))
+}
+
+func TestClearDiscriminantAfterMarshal(t *testing.T) {
+	poly := Poly{ClearDiscriminantAfterMarshal: true}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	circle := &Circle{Radius: 1}
+	rect := &Rect{Type: "stale", Width: 2}
+	doc := &struct {
+		Shapes []Shape          `json:"shapes"`
+		ByName map[string]Shape `json:"by_name"`
+		Value  Shape            `json:"value"`
+	}{
+		Shapes: []Shape{circle, rect},
+		ByName: map[string]Shape{"c": Circle{Radius: 3}},
+		Value:  Circle{Radius: 4},
+	}
+	buf, err := poly.Marshal(doc, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shapes":[{"type":"circle","radius":1},{"type":"rect","width":2,"height":0}],
+		"by_name":{"c":{"type":"circle","radius":3}},"value":{"type":"circle","radius":4}}`, string(buf))
+
+	// the discriminants are put back the way they were, also in values held by interfaces and maps
+	require.Equal(t, &Circle{Radius: 1}, circle)
+	require.Equal(t, &Rect{Type: "stale", Width: 2}, rect)
+	require.Equal(t, Circle{Radius: 3}, doc.ByName["c"])
+	require.Equal(t, Circle{Radius: 4}, doc.Value)
+
+	// the caller encodes after BeforeMarshalJSON, which leaves the discriminants stamped
+	require.NoError(t, poly.BeforeMarshalJSON(doc, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 1}, circle)
+	require.Equal(t, Circle{Type: "circle", Radius: 4}, doc.Value)
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+
+	// members are found the way encoding/json finds them, ignoring case
+	buf := []byte(`{"Shapes":[{"Type":"circle","Radius":1},{"TYPE":"rect","width":2},{"type":"circle"}]}`)
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, []Shape{
+		&Circle{Type: "circle", Radius: 1},
+		&Rect{Type: "rect", Width: 2},
+		&Circle{Type: "circle"},
+	}, req.Shapes)
+
+	var shape Shape
+	require.NoError(t, poly.Unmarshal([]byte(`{"tYpE":"rect","Height":3}`), &shape, true))
+	require.Equal(t, &Rect{Type: "rect", Height: 3}, shape)
+
+	// like encoding/json, the last member matching exactly or ignoring case wins
+	req2 := &Request{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shape":{"type":"circle","TYPE":"rect","width":3}}`), req2, true))
+	require.Equal(t, &Rect{Type: "rect", Width: 3}, req2.Shape)
+	require.NoError(t, poly.Unmarshal([]byte(`{"Shape":{"type":"rect"},"shape":{"type":"circle","radius":2}}`), req2, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 2}, req2.Shape)
+
+	// the errors report the discriminant as sent
+	var resolveErr *ResolveError
+	require.ErrorAs(t, poly.Unmarshal([]byte(`{"SHAPE":{"Type":"oval"}}`), &Request{}, true), &resolveErr)
+	require.Equal(t, "oval", resolveErr.Value)
+}
+
+func TestByteOrderMark(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+
+	buf := []byte("\xEF\xBB\xBF \n\t{\"shape\":{\"type\":\"circle\",\"radius\":1}} \r\n")
+	req := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req, true))
+	require.Equal(t, &Circle{Type: "circle", Radius: 1}, req.Shape)
+
+	req = &Request{}
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req, true))
+	require.IsType(t, &Circle{}, req.Shape)
+
+	typ, _, err := poly.ResolveType((*Shape)(nil), []byte("\xEF\xBB\xBF{\"type\":\"circle\"}"))
+	require.NoError(t, err)
+	require.Equal(t, "Circle", typ.Name())
+}
+
+// QuotedOp carries a numeric discriminant quoted as a string
+type QuotedOp struct {
+	Op   int    `json:"op,string"`
+	Name string `json:"name"`
+}
+
+func TestNumericStrings(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "op", NumericStrings()))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*QuotedOp)(nil), 1))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Opcode)(nil), 2))
+
+	req := &RequestWithSlice{}
+	buf := []byte(`{"shapes":[{"op":"1","name":"one"},{"op":2,"name":"two"},{"op":"1.0"}]}`)
+	require.NoError(t, poly.BeforeUnmarshalJSON(buf, req, true))
+	require.Equal(t, []Shape{&QuotedOp{}, &Opcode{}, &QuotedOp{}}, req.Shapes)
+
+	buf, err := poly.Marshal(&Request{Shape: &QuotedOp{Name: "one"}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"shape":{"op":"1","name":"one"}}`, string(buf))
+	req2 := &Request{}
+	require.NoError(t, poly.Unmarshal(buf, req2, true))
+	require.Equal(t, &QuotedOp{Op: 1, Name: "one"}, req2.Shape)
+
+	// only strings written as JSON numbers are taken as numbers
+	for _, op := range []string{`"01"`, `" 1"`, `"0x1"`, `"one"`} {
+		var resolveErr *ResolveError
+		require.ErrorAs(t, poly.BeforeUnmarshalJSON([]byte(`{"shape":{"op":`+op+`}}`), &Request{}, true), &resolveErr, op)
+	}
+
+	// without the option quoted numbers do not match
+	var strict Poly
+	require.NoError(t, strict.RegisterInterface((*Shape)(nil), "op"))
+	require.NoError(t, strict.RegisterStruct((*Shape)(nil), (*QuotedOp)(nil), 1))
+	var resolveErr *ResolveError
+	require.ErrorAs(t, strict.BeforeUnmarshalJSON([]byte(`{"shape":{"op":"1"}}`), &Request{}, true), &resolveErr)
+}
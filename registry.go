@@ -0,0 +1,232 @@
+package poly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// StructInfo describes where the discriminant of a registered struct was found
+type StructInfo struct {
+	// Index is the index path of the discriminant field for reflect.Value.FieldByIndex,
+	// nil when the struct has none, as for externally tagged interfaces
+	Index []int
+
+	// Path is the dotted JSON field path of the discriminant, empty when the struct has no discriminant field
+	Path string
+}
+
+// RegisterStructInfo registers a struct implementation for an interface like RegisterStruct,
+// and returns where its discriminant field was found, so tooling can check registrations
+func (p *Poly) RegisterStructInfo(iFacePtr any, structPtr any, value any) (StructInfo, error) {
+	if err := p.RegisterStruct(iFacePtr, structPtr, value); err != nil {
+		return StructInfo{}, err
+	}
+	iFaceType, _ := p.iFaceType(iFacePtr)
+	entry := p.types[iFaceType]
+	index := entry.structFieldPos[len(entry.structFieldPos)-1]
+	if index == nil {
+		return StructInfo{}, nil
+	}
+	return StructInfo{Index: index, Path: entry.discriminantFieldName}, nil
+}
+
+// RegisterFromStruct registers the types of the fields of the registry struct as implementations of
+// the interface, each with the discriminant value in its `poly` tag. Fields without the tag are skipped.
+// A tag is taken as a string for string discriminants, and as JSON text (e.g. `poly:"1"`) otherwise,
+// such as an array for composite discriminants (e.g. `poly:"[\"shape\",\"circle\"]"`)
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// registry: a struct or a pointer to one whose fields are struct pointers or structs
+// (e.g., struct{ Circle *Circle `poly:"circle"` }{})
+func (p *Poly) RegisterFromStruct(iFacePtr any, registry any) error {
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return err
+	}
+	entry, ok := p.types[iFaceType]
+	if !ok {
+		return fmt.Errorf("poly: interface type %s not registered", p.typeKey(iFaceType))
+	}
+	registryType := reflect.TypeOf(registry)
+	if registryType != nil && registryType.Kind() == reflect.Ptr {
+		registryType = registryType.Elem()
+	}
+	if registryType == nil || registryType.Kind() != reflect.Struct {
+		return errors.New("poly: registry must be a struct or a pointer to a struct")
+	}
+	for i := 0; i < registryType.NumField(); i++ {
+		f := registryType.Field(i)
+		tag, ok := f.Tag.Lookup("poly")
+		if !ok {
+			continue
+		}
+		structType := f.Type
+		if structType.Kind() == reflect.Ptr {
+			structType = structType.Elem()
+		}
+		if structType.Kind() != reflect.Struct {
+			return fmt.Errorf("poly: registry field %s must be a struct pointer or a struct, got %s", f.Name, f.Type)
+		}
+		value, err := p.tagDiscriminant(entry, structType, tag)
+		if err == nil {
+			err = p.registerStruct(iFaceType, structType, value, func() any {
+				return reflect.New(structType).Interface()
+			}, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("%w for registry field %s", err, f.Name)
+		}
+	}
+	return nil
+}
+
+// tagDiscriminant converts the `poly` tag of a registry field to the discriminant value of structType
+func (p *Poly) tagDiscriminant(entry *polyType, structType reflect.Type, tag string) (any, error) {
+	if entry.externallyTagged {
+		return tag, nil
+	}
+	if entry.compositeFields == nil {
+		_, fieldType, err := p.discriminantFieldIndex(entry, structType, entry.discriminantFieldName)
+		if err != nil || p.pointee(fieldType).Kind() == reflect.String {
+			// registerStruct reports a missing discriminant field
+			return tag, nil
+		}
+	}
+	var value any
+	if err := json.Unmarshal([]byte(tag), &value); err != nil {
+		return nil, fmt.Errorf("poly: cannot parse discriminant %q of struct %s: %w", tag, structType, err)
+	}
+	return value, nil
+}
+
+// RegisterSlice registers the types of the struct pointers in impls as implementations of the interface,
+// each with the discriminant value computed by valueFor, so registrations follow a single list of the
+// implementations (e.g. []any{&Circle{}, &Rect{}}). The values in impls are only used for their types
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+// valueFor: returns the discriminant value of a struct type, e.g. derived from its name
+func (p *Poly) RegisterSlice(iFacePtr any, impls []any, valueFor func(reflect.Type) any) error {
+	if valueFor == nil {
+		return errors.New("poly: valueFor must not be nil")
+	}
+	for i, impl := range impls {
+		if impl == nil {
+			return fmt.Errorf("poly: struct pointer must be a pointer, got nil for implementation %d", i)
+		}
+		structType, err := p.structType(impl)
+		if err == nil {
+			err = p.RegisterStruct(iFacePtr, impl, valueFor(structType))
+		}
+		if err != nil {
+			return fmt.Errorf("%w for implementation %d", err, i)
+		}
+	}
+	return nil
+}
+
+// RegisterWireNames gives the fields of a struct the names they have on the wire when it marshals itself
+// with a custom MarshalJSON renaming them, so its json tags no longer describe the bytes. Field paths, in
+// errors and OnResolve, and the discriminant lookups then use the wire names, and the pre-passes walk into
+// the struct instead of leaving it to its marshaler as an opaque value. Its UnmarshalJSON must decode
+// into the interface values already set in the struct. Fields left out keep their json names
+// structPtr: a pointer to the struct type (e.g., (*Envelope)(nil))
+// names: maps Go field names to wire names (e.g., map[string]string{"Shape": "figure"})
+func (p *Poly) RegisterWireNames(structPtr any, names map[string]string) error {
+	structType, err := p.structType(structPtr)
+	if err != nil {
+		return err
+	}
+	wireNames := make(map[string]string, len(names))
+	for goName, wireName := range names {
+		f, ok := structType.FieldByName(goName)
+		if !ok || len(f.Index) != 1 || !p.isVisible(f) || p.isPromoted(f) {
+			return fmt.Errorf("poly: struct %s has no field %s to name", structType, goName)
+		}
+		if wireName == "" {
+			return fmt.Errorf("poly: wire name of field %s of struct %s must not be empty", goName, structType)
+		}
+		wireNames[goName] = wireName
+	}
+	if p.wireNames == nil {
+		p.wireNames = make(map[reflect.Type]map[string]string)
+	}
+	p.wireNames[structType] = wireNames
+	return nil
+}
+
+// Stats counts the registrations of a Poly, e.g. for a metrics endpoint
+type Stats struct {
+	// Interfaces is the number of registered interfaces
+	Interfaces int
+
+	// Structs is the number of registered structs over all interfaces, a struct registered
+	// for two interfaces counting twice
+	Structs int
+
+	// Variants maps every registered interface type to its number of registered structs. It is keyed
+	// by type since interfaces declared in different functions may share a name, see Registered for
+	// a listing sorted by name
+	Variants map[reflect.Type]int
+}
+
+// Stats returns the counts of the interfaces and structs registered so far
+func (p *Poly) Stats() Stats {
+	stats := Stats{Interfaces: len(p.types), Variants: make(map[reflect.Type]int, len(p.types))}
+	for iFaceType, entry := range p.types {
+		stats.Structs += len(entry.structTypes)
+		stats.Variants[iFaceType] = len(entry.structTypes)
+	}
+	return stats
+}
+
+// RegisteredInterface describes a registered interface and the structs registered for it
+type RegisteredInterface struct {
+	// Name is the name of the interface as used in messages (e.g. "github.com/reyoung/poly.Shape")
+	Name string
+
+	// Type is the interface type
+	Type reflect.Type
+
+	// DiscriminantField is the discriminant field path the interface was registered with
+	DiscriminantField string
+
+	// Structs are the registered struct types, in the order Unmarshal tries them
+	Structs []reflect.Type
+
+	// Values are the discriminant values of Structs, nil for the structs registered without one
+	Values []any
+}
+
+// Registered returns the registered interfaces sorted by name, and those sharing a name in the order
+// they were registered, so listings generated from it, e.g. documentation or golden files, do not
+// change from run to run
+func (p *Poly) Registered() []RegisteredInterface {
+	var registered []RegisteredInterface
+	for _, entry := range p.sortedEntries() {
+		registered = append(registered, RegisteredInterface{
+			Name:              p.typeKey(entry.fieldType),
+			Type:              entry.fieldType,
+			DiscriminantField: entry.discriminantFieldName,
+			Structs:           append([]reflect.Type(nil), entry.structTypes...),
+			Values:            append([]any(nil), entry.structValues...),
+		})
+	}
+	return registered
+}
+
+// sortedEntries returns the registered interfaces sorted by name, to iterate them in a stable order.
+// Interfaces of the same name, e.g. declared in different functions, keep their order of registration
+func (p *Poly) sortedEntries() []*polyType {
+	entries := make([]*polyType, 0, len(p.types))
+	for _, entry := range p.types {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if iKey, jKey := p.typeKey(entries[i].fieldType), p.typeKey(entries[j].fieldType); iKey != jKey {
+			return iKey < jKey
+		}
+		return entries[i].order < entries[j].order
+	})
+	return entries
+}
@@ -0,0 +1,307 @@
+package poly
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterFromStruct(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterFromStruct((*Shape)(nil), struct {
+		Circle *Circle `poly:"circle"`
+		Rect   *Rect   `poly:"rect"`
+		Square Square  `poly:"square"`
+		Note   string
+	}{}))
+
+	var shapes []Shape
+	buf := []byte(`[{"type":"circle","radius":1},{"type":"rect","width":2},{"type":"square","side":3}]`)
+	require.NoError(t, poly.Unmarshal(buf, &shapes, true))
+	require.Equal(t, []Shape{
+		&Circle{Type: "circle", Radius: 1},
+		&Rect{Type: "rect", Width: 2},
+		&Square{Type: "square", Side: 3},
+	}, shapes)
+
+	// tags of non-string discriminants are JSON text
+	type IntCircle struct {
+		Type   int     `json:"type"`
+		Radius float64 `json:"radius"`
+	}
+	type IntRect struct {
+		Type  int     `json:"type"`
+		Width float64 `json:"width"`
+	}
+	var intPoly Poly
+	require.NoError(t, intPoly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, intPoly.RegisterFromStruct((*Shape)(nil), &struct {
+		Circle *IntCircle `poly:"1"`
+		Rect   *IntRect   `poly:"2"`
+	}{}))
+	buf = []byte(`[{"type":2,"width":4},{"type":1,"radius":5}]`)
+	require.NoError(t, intPoly.Unmarshal(buf, &shapes, true))
+	require.Equal(t, []Shape{&IntRect{Type: 2, Width: 4}, &IntCircle{Type: 1, Radius: 5}}, shapes)
+
+	err := intPoly.RegisterFromStruct((*Shape)(nil), struct {
+		Circle *IntCircle `poly:"one"`
+	}{})
+	require.ErrorContains(t, err, `poly: cannot parse discriminant "one" of struct poly.IntCircle`)
+	require.ErrorContains(t, err, "for registry field Circle")
+}
+
+func TestRegisterFromStructErrors(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+
+	err := poly.RegisterFromStruct((*Measurable)(nil), struct {
+		Square *Square `poly:"square"`
+		Circle *Circle `poly:"circle"`
+	}{})
+	require.ErrorContains(t, err, "struct ptr must implements interface for registry field Circle")
+
+	err = poly.RegisterFromStruct((*Measurable)(nil), struct {
+		Name string `poly:"name"`
+	}{})
+	require.ErrorContains(t, err, "poly: registry field Name must be a struct pointer or a struct, got string")
+
+	err = poly.RegisterFromStruct((*Measurable)(nil), []*Square{})
+	require.ErrorContains(t, err, "poly: registry must be a struct or a pointer to a struct")
+
+	err = poly.RegisterFromStruct((*Shape)(nil), struct{}{})
+	require.ErrorContains(t, err, "not registered")
+}
+
+func TestRegisterStructInfo(t *testing.T) {
+	// NestedEmbedCircle reaches its discriminant through an embedded pointer and a nested object
+	type NestedEmbedCircle struct {
+		Radius float64 `json:"radius"`
+		*MetaCircle
+	}
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "meta.kind"))
+	info, err := poly.RegisterStructInfo((*Shape)(nil), (*NestedEmbedCircle)(nil), "circle")
+	require.NoError(t, err)
+	require.Equal(t, StructInfo{Index: []int{1, 0, 0}, Path: "meta.kind"}, info)
+
+	info, err = poly.RegisterStructInfo((*Shape)(nil), (*MetaRect)(nil), "rect")
+	require.NoError(t, err)
+	require.Equal(t, StructInfo{Index: []int{0, 0}, Path: "meta.kind"}, info)
+
+	_, err = poly.RegisterStructInfo((*Shape)(nil), (*Circle)(nil), "plain")
+	require.ErrorContains(t, err, "not found in struct")
+
+	var pets Poly
+	require.NoError(t, pets.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	info, err = pets.RegisterStructInfo((*Pet)(nil), (*Cat)(nil), "kitten")
+	require.NoError(t, err)
+	require.Equal(t, StructInfo{}, info)
+}
+
+func TestRegisterSlice(t *testing.T) {
+	allShapes := []any{&Circle{}, (*Rect)(nil)}
+	poly := &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterSlice((*Shape)(nil), allShapes, func(t reflect.Type) any {
+		return strings.ToLower(t.Name())
+	}))
+
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":[{"type":"rect","width":1},{"type":"circle"}]}`), req, true))
+	require.Equal(t, []Shape{&Rect{Type: "rect", Width: 1}, &Circle{Type: "circle"}}, req.Shapes)
+
+	poly = &Poly{}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	valueFor := func(t reflect.Type) any { return t.Name() }
+	err := poly.RegisterSlice((*Shape)(nil), []any{&Circle{}, nil}, valueFor)
+	require.EqualError(t, err, "poly: struct pointer must be a pointer, got nil for implementation 1")
+	err = poly.RegisterSlice((*Shape)(nil), []any{Rect{}}, valueFor)
+	require.EqualError(t, err, "poly: struct pointer must be a pointer for implementation 0")
+	err = poly.RegisterSlice((*Measurable)(nil), []any{&Disk{}}, valueFor)
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Measurable not registered for implementation 0")
+	require.EqualError(t, poly.RegisterSlice((*Shape)(nil), nil, nil), "poly: valueFor must not be nil")
+}
+
+func TestRegisterTypes(t *testing.T) {
+	shapeType := reflect.TypeOf((*Shape)(nil)).Elem()
+	var poly Poly
+	require.NoError(t, poly.RegisterInterfaceType(shapeType, "type"))
+	require.NoError(t, poly.RegisterStructType(shapeType, reflect.TypeOf(Circle{}), "circle"))
+	require.NoError(t, poly.RegisterStructType(shapeType, reflect.TypeOf(&Rect{}).Elem(), "rect"))
+
+	req := &RequestWithSlice{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"shapes":[{"type":"circle","radius":1},{"type":"rect","width":2}]}`), req, true))
+	require.Equal(t, []Shape{&Circle{Type: "circle", Radius: 1}, &Rect{Type: "rect", Width: 2}}, req.Shapes)
+
+	err := poly.RegisterInterfaceType(reflect.TypeOf((*Shape)(nil)), "type")
+	require.EqualError(t, err, "poly: interface type must be an interface, got *poly.Shape")
+	err = poly.RegisterInterfaceType(nil, "type")
+	require.EqualError(t, err, "poly: interface type must be an interface, got <nil>")
+	err = poly.RegisterStructType(shapeType, reflect.TypeOf(&Circle{}), "circle")
+	require.EqualError(t, err, "poly: struct type must be a struct, got *poly.Circle")
+	err = poly.RegisterStructType(reflect.TypeOf(Circle{}), reflect.TypeOf(Circle{}), "circle")
+	require.EqualError(t, err, "poly: interface type must be an interface, got poly.Circle")
+}
+
+func TestStats(t *testing.T) {
+	var poly Poly
+	require.Equal(t, Stats{Variants: map[reflect.Type]int{}}, poly.Stats())
+
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+	require.NoError(t, poly.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	require.Equal(t, Stats{
+		Interfaces: 3,
+		Structs:    3,
+		Variants: map[reflect.Type]int{
+			reflect.TypeOf((*Shape)(nil)).Elem():      2,
+			reflect.TypeOf((*Measurable)(nil)).Elem(): 1,
+			reflect.TypeOf((*Pet)(nil)).Elem():        0,
+		},
+	}, poly.Stats())
+}
+
+// localAnimal returns the type of an interface declared in a function, named like the one of localAnimalToo
+func localAnimal() reflect.Type {
+	type Animal interface{ Sound() string }
+	return reflect.TypeOf((*Animal)(nil)).Elem()
+}
+
+func localAnimalToo() reflect.Type {
+	type Animal interface{ Area() float64 }
+	return reflect.TypeOf((*Animal)(nil)).Elem()
+}
+
+func TestStatsSameNamedInterfaces(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterfaceType(localAnimal(), "type"))
+	require.NoError(t, poly.RegisterInterfaceType(localAnimalToo(), "type"))
+	require.NoError(t, poly.RegisterStructType(localAnimalToo(), reflect.TypeOf(Disk{}), "disk"))
+
+	// both are counted although they share the name github.com/reyoung/poly.Animal
+	require.Equal(t, Stats{
+		Interfaces: 2,
+		Structs:    1,
+		Variants:   map[reflect.Type]int{localAnimal(): 0, localAnimalToo(): 1},
+	}, poly.Stats())
+}
+
+// RenamedRequest marshals its shape under "figure" although its tag says "shape"
+type RenamedRequest struct {
+	Shape Shape `json:"shape"`
+}
+
+func (r RenamedRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Figure Shape `json:"figure"`
+	}{r.Shape})
+}
+
+func (r *RenamedRequest) UnmarshalJSON(buf []byte) error {
+	return json.Unmarshal(buf, &struct {
+		Figure *Shape `json:"figure"`
+	}{&r.Shape})
+}
+
+func TestRegisterWireNames(t *testing.T) {
+	var paths []string
+	poly := Poly{OnResolve: func(path string, iface reflect.Type, chosen reflect.Type, value any) {
+		paths = append(paths, path)
+	}}
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	buf := []byte(`{"requests":[{"figure":{"type":"circle","radius":1}}]}`)
+
+	// the struct is left to its marshaler, which decodes the shape as generic JSON
+	var doc struct {
+		Requests []RenamedRequest `json:"requests"`
+	}
+	require.NoError(t, poly.Unmarshal(buf, &doc, true))
+	require.IsType(t, map[string]any{}, doc.Requests[0].Shape)
+
+	require.NoError(t, poly.RegisterWireNames((*RenamedRequest)(nil), map[string]string{"Shape": "figure"}))
+	require.NoError(t, poly.Unmarshal(buf, &doc, true))
+	require.Equal(t, []RenamedRequest{{Shape: &Circle{Type: "circle", Radius: 1}}}, doc.Requests)
+	require.Equal(t, []string{"requests.0.figure"}, paths)
+
+	out, err := poly.Marshal(&RenamedRequest{Shape: &Circle{Radius: 2}}, true)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"figure":{"type":"circle","radius":2}}`, string(out))
+
+	var resolveErr *ResolveError
+	err = poly.Unmarshal([]byte(`{"requests":[{"figure":{"type":"oval"}}]}`), &doc, true)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Contains(t, err.Error(), "requests.0.figure")
+
+	require.ErrorContains(t, poly.RegisterWireNames((*RenamedRequest)(nil), map[string]string{"Figure": "figure"}),
+		"poly: struct poly.RenamedRequest has no field Figure to name")
+	require.ErrorContains(t, poly.RegisterWireNames((*RenamedRequest)(nil), map[string]string{"Shape": ""}),
+		"poly: wire name of field Shape of struct poly.RenamedRequest must not be empty")
+}
+
+func TestRegistered(t *testing.T) {
+	register := func(order []int) *Poly {
+		poly := &Poly{}
+		for _, i := range order {
+			switch i {
+			case 0:
+				require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+				require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Rect)(nil), "rect"))
+				require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+			case 1:
+				require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+				require.NoError(t, poly.RegisterStruct((*Measurable)(nil), (*Disk)(nil), "disk"))
+			case 2:
+				require.NoError(t, poly.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+			}
+		}
+		return poly
+	}
+
+	registered := register([]int{0, 1, 2}).Registered()
+	require.Equal(t, []RegisteredInterface{
+		{
+			Name:              "github.com/reyoung/poly.Measurable",
+			Type:              reflect.TypeOf((*Measurable)(nil)).Elem(),
+			DiscriminantField: "type",
+			Structs:           []reflect.Type{reflect.TypeOf(Disk{})},
+			Values:            []any{"disk"},
+		},
+		{
+			Name: "github.com/reyoung/poly.Pet",
+			Type: reflect.TypeOf((*Pet)(nil)).Elem(),
+		},
+		{
+			Name:              "github.com/reyoung/poly.Shape",
+			Type:              reflect.TypeOf((*Shape)(nil)).Elem(),
+			DiscriminantField: "type",
+			Structs:           []reflect.Type{reflect.TypeOf(Rect{}), reflect.TypeOf(Circle{})},
+			Values:            []any{"rect", "circle"},
+		},
+	}, registered)
+
+	// the order does not depend on the order of registration nor on map iteration
+	for i := 0; i < 20; i++ {
+		require.Equal(t, registered, register([]int{2, 1, 0}).Registered())
+		require.Equal(t, registered, register([]int{1, 0, 2}).Registered())
+	}
+	require.Nil(t, (&Poly{}).Registered())
+
+	// interfaces sharing a name keep the order they were registered in
+	for i := 0; i < 20; i++ {
+		poly := &Poly{}
+		require.NoError(t, poly.RegisterInterfaceType(localAnimalToo(), "kind"))
+		require.NoError(t, poly.RegisterInterfaceType(localAnimal(), "type"))
+		registered := poly.Registered()
+		require.Len(t, registered, 2)
+		require.Equal(t, localAnimalToo(), registered[0].Type)
+		require.Equal(t, localAnimal(), registered[1].Type)
+	}
+}
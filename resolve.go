@@ -0,0 +1,61 @@
+package poly
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ResolveType returns the struct type the document buf resolves to as the interface, together with its
+// discriminant value, without decoding it. Only the top-level discriminant of buf is read, so interfaces
+// registered with ParentDiscriminant cannot be resolved this way
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+func (p *Poly) ResolveType(iFacePtr any, buf []byte) (reflect.Type, any, error) {
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, ok := p.types[iFaceType]
+	if !ok {
+		return nil, nil, fmt.Errorf("poly: interface type %s not registered", p.typeKey(iFaceType))
+	}
+	if entry.parentLevels != 0 {
+		return nil, nil, fmt.Errorf("poly: interface %s reads its discriminant outside the document", p.typeKey(iFaceType))
+	}
+	node, err := p.parseJSON(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.externallyTagged {
+		pos, _, _ := p.externalVariant(entry, node)
+		if pos == -1 {
+			return nil, nil, &ResolveError{Interface: p.typeKey(iFaceType), Raw: node.Raw()}
+		}
+		return entry.structTypes[pos], entry.structValues[pos], nil
+	}
+	pos := p.matchObject(entry, node)
+	if pos == -1 {
+		return nil, nil, &ResolveError{
+			Interface: p.typeKey(iFaceType),
+			Path:      p.discriminantLocator(entry),
+			Value:     p.discriminantOf(entry, node),
+			Raw:       node.Raw(),
+		}
+	}
+	return entry.structTypes[pos], entry.structValues[pos], nil
+}
+
+// DecodeRaw resolves and unmarshals the single interface value held by raw, such as a json.RawMessage
+// field whose polymorphic content is decoded lazily. It returns the concrete value, e.g. a *Circle
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+func (p *Poly) DecodeRaw(iFacePtr any, raw json.RawMessage) (any, error) {
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.New(iFaceType)
+	if err := p.Unmarshal(raw, ptr.Interface(), true); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
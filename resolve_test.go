@@ -0,0 +1,69 @@
+package poly
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveType(t *testing.T) {
+	poly := newShapePoly(t)
+
+	typ, value, err := poly.ResolveType((*Shape)(nil), []byte(`{"type":"rect","width":1}`))
+	require.NoError(t, err)
+	require.Equal(t, reflect.TypeOf(Rect{}), typ)
+	require.Equal(t, "rect", value)
+
+	_, _, err = poly.ResolveType((*Shape)(nil), []byte(`{"type":"hexagon"}`))
+	var resolveErr *ResolveError
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, "type", resolveErr.Path)
+	require.Equal(t, "hexagon", resolveErr.Value)
+
+	// a truncated document has no discriminant to read
+	_, _, err = poly.ResolveType((*Shape)(nil), []byte(`{"type":`))
+	require.Error(t, err)
+
+	_, _, err = poly.ResolveType((*Measurable)(nil), []byte(`{"type":"square"}`))
+	require.ErrorContains(t, err, "not registered")
+
+	// externally tagged interfaces resolve by the key of the document
+	pets := &Poly{}
+	require.NoError(t, pets.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	require.NoError(t, pets.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	require.NoError(t, pets.RegisterStruct((*Pet)(nil), (*Dog)(nil), "dog"))
+	typ, value, err = pets.ResolveType((*Pet)(nil), []byte(`{"dog":{"name":"rex"}}`))
+	require.NoError(t, err)
+	require.Equal(t, reflect.TypeOf(Dog{}), typ)
+	require.Equal(t, "dog", value)
+	_, _, err = pets.ResolveType((*Pet)(nil), []byte(`{"fish":{}}`))
+	require.ErrorAs(t, err, &resolveErr)
+}
+
+func TestDecodeRaw(t *testing.T) {
+	poly := newShapePoly(t)
+
+	type Envelope struct {
+		Kind    string          `json:"kind"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	env := &Envelope{}
+	require.NoError(t, poly.Unmarshal([]byte(`{"kind":"shape","payload":{"type":"circle","radius":2}}`), env, true))
+
+	shape, err := poly.DecodeRaw((*Shape)(nil), env.Payload)
+	require.NoError(t, err)
+	require.Equal(t, &Circle{Type: "circle", Radius: 2}, shape)
+
+	shape, err = poly.DecodeRaw((*Shape)(nil), json.RawMessage(`null`))
+	require.NoError(t, err)
+	require.Nil(t, shape)
+
+	_, err = poly.DecodeRaw((*Shape)(nil), json.RawMessage(`{"type":"hexagon"}`))
+	var resolveErr *ResolveError
+	require.ErrorAs(t, err, &resolveErr)
+
+	_, err = poly.DecodeRaw((*Measurable)(nil), json.RawMessage(`{"type":"square"}`))
+	require.ErrorContains(t, err, "not registered")
+}
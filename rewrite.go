@@ -0,0 +1,229 @@
+package poly
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonRewrite is a change to the value at a field path of the encoded document that encoding/json
+// cannot make by itself
+type jsonRewrite struct {
+	// path is the JSON field path of the value
+	path []string
+
+	// wrap nests the value under this key when not empty, for externally tagged interfaces
+	wrap string
+
+	// tuple pairs the value with the wrap key in a two-element array instead, for tuple tagged interfaces
+	tuple bool
+
+	// first moves the member of the object with this name to the front when not empty
+	first string
+
+	// insert is the encoded member added to the front of the object when not empty, for DiscriminantMethod
+	insert string
+
+	// replace is the encoded value replacing the value when not empty, for nested fields
+	replace string
+}
+
+// rewriteTrie holds the rewrites by field path, keyed segment by segment
+type rewriteTrie struct {
+	wrap     string
+	tuple    bool
+	first    string
+	insert   string
+	replace  string
+	children map[string]*rewriteTrie
+
+	// fold matches members to children ignoring case when no child has their exact name,
+	// like json.Unmarshal matches members to fields
+	fold bool
+
+	// null keeps replacing the value with null when it is decoded as a document of its own
+	null bool
+}
+
+// child returns the trie of the value at segment below t, adding it when missing
+func (t *rewriteTrie) child(segment string) *rewriteTrie {
+	c := t.children[segment]
+	if c == nil {
+		if t.children == nil {
+			t.children = make(map[string]*rewriteTrie)
+		}
+		c = &rewriteTrie{fold: t.fold}
+		t.children[segment] = c
+	}
+	return c
+}
+
+// member returns the trie of the member named name of the object t describes, nil when it has no rewrites
+func (t *rewriteTrie) member(name string) *rewriteTrie {
+	if c := t.children[name]; c != nil || !t.fold {
+		return c
+	}
+	for segment, c := range t.children {
+		if strings.EqualFold(segment, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// jsonEdit replaces the bytes from offset to end of an encoded document with text
+type jsonEdit struct {
+	offset int
+	end    int
+	text   string
+}
+
+// rewrite applies rewrites to the document buf
+func (p *Poly) rewrite(buf []byte, rewrites []jsonRewrite) ([]byte, error) {
+	if len(rewrites) == 0 {
+		return buf, nil
+	}
+	root := &rewriteTrie{}
+	for _, rw := range rewrites {
+		t := root
+		for _, segment := range rw.path {
+			t = t.child(segment)
+		}
+		if rw.wrap != "" {
+			t.wrap, t.tuple = rw.wrap, rw.tuple
+		}
+		if rw.first != "" {
+			t.first = rw.first
+		}
+		if rw.insert != "" {
+			t.insert = rw.insert
+		}
+		if rw.replace != "" {
+			t.replace = rw.replace
+		}
+	}
+	return p.applyRewrites(buf, root)
+}
+
+// applyRewrites applies the rewrites held by root to the document buf
+func (p *Poly) applyRewrites(buf []byte, root *rewriteTrie) ([]byte, error) {
+	var edits []jsonEdit
+	if err := p.findEdits(json.NewDecoder(bytes.NewReader(buf)), buf, root, &edits); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].offset < edits[j].offset })
+	var out bytes.Buffer
+	out.Grow(len(buf) + len(edits)*8)
+	last := 0
+	for _, edit := range edits {
+		out.Write(buf[last:edit.offset])
+		out.WriteString(edit.text)
+		last = edit.end
+	}
+	out.Write(buf[last:])
+	return out.Bytes(), nil
+}
+
+// findEdits reads the next value from dec, and collects the edits t describes for it and the values inside it
+func (p *Poly) findEdits(dec *json.Decoder, buf []byte, t *rewriteTrie, edits *[]jsonEdit) error {
+	if t.replace != "" {
+		start := valueStart(dec, buf)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		*edits = append(*edits, jsonEdit{offset: start, end: int(dec.InputOffset()), text: t.replace})
+		return nil
+	}
+	if t.wrap != "" {
+		key, err := json.Marshal(t.wrap)
+		if err != nil {
+			return err
+		}
+		prefix := "{" + string(key) + ":"
+		if t.tuple {
+			prefix = "[" + string(key) + ","
+		}
+		start := valueStart(dec, buf)
+		*edits = append(*edits, jsonEdit{offset: start, end: start, text: prefix})
+	}
+	if len(t.children) == 0 && t.first == "" && t.insert == "" {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+	} else {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		open := int(dec.InputOffset())
+		if token == json.Delim('{') && t.insert != "" {
+			text := t.insert
+			if dec.More() {
+				text += ","
+			}
+			*edits = append(*edits, jsonEdit{offset: open, end: open, text: text})
+		}
+		if token == json.Delim('{') || token == json.Delim('[') {
+			for i := 0; dec.More(); i++ {
+				prevEnd := int(dec.InputOffset())
+				segment := strconv.Itoa(i)
+				if token == json.Delim('{') {
+					name, err := dec.Token()
+					if err != nil {
+						return err
+					}
+					segment = name.(string)
+				}
+				child := t.children[segment]
+				if token == json.Delim('{') {
+					child = t.member(segment)
+				}
+				if child == nil {
+					child = &rewriteTrie{}
+				}
+				memberStart, editCount := prevEnd, len(*edits)
+				if i > 0 {
+					// the member itself starts after the comma separating it from the previous one
+					memberStart = bytes.IndexByte(buf[prevEnd:], ',') + prevEnd + 1
+				}
+				if err := p.findEdits(dec, buf, child, edits); err != nil {
+					return err
+				}
+				// move the member to the front, unless it is first already or has edits of its own
+				if token == json.Delim('{') && segment == t.first && i > 0 && len(*edits) == editCount {
+					end := int(dec.InputOffset())
+					member := strings.TrimSpace(string(buf[memberStart:end]))
+					*edits = append(*edits,
+						jsonEdit{offset: open, end: open, text: member + ","},
+						jsonEdit{offset: prevEnd, end: end})
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+		}
+	}
+	if t.wrap != "" {
+		closing := "}"
+		if t.tuple {
+			closing = "]"
+		}
+		end := int(dec.InputOffset())
+		*edits = append(*edits, jsonEdit{offset: end, end: end, text: closing})
+	}
+	return nil
+}
+
+// valueStart returns the offset of the next value in buf read by dec. The decoder offset is the end
+// of the previous token, so the value starts after the separators and whitespace following it
+func valueStart(dec *json.Decoder, buf []byte) int {
+	start := int(dec.InputOffset())
+	for start < len(buf) && strings.IndexByte(" \t\r\n,:", buf[start]) >= 0 {
+		start++
+	}
+	return start
+}
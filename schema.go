@@ -0,0 +1,87 @@
+package poly
+
+import "fmt"
+
+// JSONSchema returns a JSON Schema fragment describing the registered structs of the interface: a `oneOf`
+// referencing one definition under `$defs` per struct, named after the struct, that only pins down its
+// discriminant, and a `discriminator` with the discriminant field as `propertyName` and the `mapping`
+// from discriminant values to definitions. The rest of the struct shapes is not described. Externally
+// tagged interfaces get no discriminator, their definitions require the key of the struct instead, or
+// describe the pair of a tuple tagged interface, and neither do interfaces registered with SingleStruct.
+// Structs registered without a discriminant are described as any object, outside the mapping
+// iFacePtr: a pointer to the interface type (e.g., (*Shape)(nil))
+func (p *Poly) JSONSchema(iFacePtr any) (map[string]any, error) {
+	iFaceType, err := p.iFaceType(iFacePtr)
+	if err != nil {
+		return nil, err
+	}
+	key := p.typeKey(iFaceType)
+	entry, ok := p.types[iFaceType]
+	if !ok {
+		return nil, fmt.Errorf("poly: interface type %s not registered", key)
+	}
+	if entry.discriminantQuery != "" || entry.compositeFields != nil || entry.parentLevels != 0 || entry.hasMatchers {
+		return nil, fmt.Errorf("poly: cannot describe the discriminant query, composite, parent discriminant or predicates of interface %s in a schema", key)
+	}
+	if len(entry.structTypes) == 0 {
+		return nil, fmt.Errorf("poly: interface %s has no registered structs", key)
+	}
+
+	absent := p.absentMatch(entry)
+	defs := make(map[string]any, len(entry.structTypes))
+	oneOf := make([]any, 0, len(entry.structTypes))
+	mapping := make(map[string]any, len(entry.structTypes))
+	for pos, structType := range entry.structTypes {
+		name := structType.Name()
+		if _, ok := defs[name]; ok || name == "" {
+			name = fmt.Sprintf("%s%d", name, pos)
+		}
+		ref := "#/$defs/" + name
+		value := entry.structValues[pos]
+		if entry.tupleTagged {
+			defs[name] = map[string]any{
+				"type":        "array",
+				"prefixItems": []any{map[string]any{"const": value}, map[string]any{"type": "object"}},
+				"minItems":    2,
+				"maxItems":    2,
+			}
+		} else if entry.externallyTagged {
+			defs[name] = p.schemaObject(value.(string), map[string]any{"type": "object"}, true)
+		} else if entry.singleStruct || p.discriminantless(entry, pos) {
+			defs[name] = map[string]any{"type": "object"}
+		} else {
+			defs[name] = p.schemaProperty(splitJSONPath(entry.discriminantFieldName), value, pos != absent)
+			mapping[fmt.Sprint(value)] = ref
+		}
+		oneOf = append(oneOf, map[string]any{"$ref": ref})
+	}
+
+	schema := map[string]any{"oneOf": oneOf, "$defs": defs}
+	if !entry.externallyTagged && !entry.singleStruct {
+		schema["discriminator"] = map[string]any{
+			"propertyName": entry.discriminantFieldName,
+			"mapping":      mapping,
+		}
+	}
+	return schema, nil
+}
+
+// schemaProperty returns the schema of an object holding the constant value at the field path
+func (p *Poly) schemaProperty(path []string, value any, required bool) map[string]any {
+	if len(path) == 1 {
+		return p.schemaObject(path[0], map[string]any{"const": value}, required)
+	}
+	return p.schemaObject(path[0], p.schemaProperty(path[1:], value, required), required)
+}
+
+// schemaObject returns the schema of an object with the single described property name
+func (p *Poly) schemaObject(name string, property map[string]any, required bool) map[string]any {
+	object := map[string]any{
+		"type":       "object",
+		"properties": map[string]any{name: property},
+	}
+	if required {
+		object["required"] = []any{name}
+	}
+	return object
+}
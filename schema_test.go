@@ -0,0 +1,66 @@
+package poly
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := newShapePoly(t).JSONSchema((*Shape)(nil))
+	require.NoError(t, err)
+	buf, err := json.Marshal(schema)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"oneOf":[{"$ref":"#/$defs/Circle"},{"$ref":"#/$defs/Rect"}],
+		"discriminator":{"propertyName":"type","mapping":{"circle":"#/$defs/Circle","rect":"#/$defs/Rect"}},
+		"$defs":{
+			"Circle":{"type":"object","properties":{"type":{"const":"circle"}},"required":["type"]},
+			"Rect":{"type":"object","properties":{"type":{"const":"rect"}},"required":["type"]}
+		}
+	}`, string(buf))
+
+	// nested discriminants are described as nested objects, the default struct may leave them out
+	var nested Poly
+	require.NoError(t, nested.RegisterInterface((*Shape)(nil), "meta.kind", DefaultStruct((*MetaRect)(nil))))
+	require.NoError(t, nested.RegisterStruct((*Shape)(nil), (*MetaCircle)(nil), "circle"))
+	require.NoError(t, nested.RegisterStruct((*Shape)(nil), (*MetaRect)(nil), "rect"))
+	schema, err = nested.JSONSchema((*Shape)(nil))
+	require.NoError(t, err)
+	buf, err = json.Marshal(schema["$defs"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"MetaCircle":{"type":"object","properties":{"meta":{"type":"object","properties":{"kind":{"const":"circle"}},"required":["kind"]}},"required":["meta"]},
+		"MetaRect":{"type":"object","properties":{"meta":{"type":"object","properties":{"kind":{"const":"rect"}}}}}
+	}`, string(buf))
+
+	var pets Poly
+	require.NoError(t, pets.RegisterInterface((*Pet)(nil), "", ExternallyTagged()))
+	require.NoError(t, pets.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	require.NoError(t, pets.RegisterStruct((*Pet)(nil), (*Dog)(nil), "dog"))
+	schema, err = pets.JSONSchema((*Pet)(nil))
+	require.NoError(t, err)
+	require.NotContains(t, schema, "discriminator")
+	buf, err = json.Marshal(schema["$defs"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"Cat":{"type":"object","properties":{"cat":{"type":"object"}},"required":["cat"]},
+		"Dog":{"type":"object","properties":{"dog":{"type":"object"}},"required":["dog"]}
+	}`, string(buf))
+
+	var tuple Poly
+	require.NoError(t, tuple.RegisterInterface((*Pet)(nil), "", TupleTagged()))
+	require.NoError(t, tuple.RegisterStruct((*Pet)(nil), (*Cat)(nil), "cat"))
+	schema, err = tuple.JSONSchema((*Pet)(nil))
+	require.NoError(t, err)
+	require.NotContains(t, schema, "discriminator")
+	buf, err = json.Marshal(schema["$defs"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"Cat":{"type":"array","prefixItems":[{"const":"cat"},{"type":"object"}],"minItems":2,"maxItems":2}
+	}`, string(buf))
+
+	_, err = newShapePoly(t).JSONSchema((*Measurable)(nil))
+	require.ErrorContains(t, err, "not registered")
+}
@@ -0,0 +1,147 @@
+package poly
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Validate checks the registry for mistakes that would otherwise only surface while handling documents:
+// interfaces without registered structs or with an unregistered DefaultStruct, and discriminant values
+// registered for more than one struct. Discriminant values not fitting their field fail RegisterStruct.
+// All problems found are joined into the returned error, so it can be checked once at startup
+func (p *Poly) Validate() error {
+	var errs []error
+	for _, entry := range p.sortedEntries() {
+		errs = append(errs, p.validateInterface(p.typeKey(entry.fieldType), entry)...)
+	}
+	return errors.Join(errs...)
+}
+
+// validateInterface returns the problems found in the registration of a single interface
+func (p *Poly) validateInterface(key string, entry *polyType) []error {
+	if len(entry.structTypes) == 0 {
+		return []error{fmt.Errorf("poly: interface %s has no registered structs", key)}
+	}
+
+	var errs []error
+	if entry.defaultStruct != nil && p.absentMatch(entry) == -1 {
+		errs = append(errs, fmt.Errorf("poly: default struct %s of interface %s is not registered",
+			entry.defaultStruct.Elem(), key))
+	}
+	for i, structType := range entry.structTypes {
+		if entry.structMatchers[i] != nil || p.discriminantless(entry, i) {
+			// a predicate may accept the values of other structs, the first registered one wins,
+			// and structs registered without a discriminant have no value to clash
+			continue
+		}
+		for j := 0; j < i; j++ {
+			a, b := entry.structValues[j], entry.structValues[i]
+			if entry.normalize != nil {
+				a, b = entry.normalize(a), entry.normalize(b)
+			}
+			if entry.structMatchers[j] == nil && !p.discriminantless(entry, j) && p.sameDiscriminant(a, b) {
+				errs = append(errs, fmt.Errorf("poly: discriminant value %#v of interface %s is registered for both %s and %s",
+					entry.structValues[i], key, entry.structTypes[j], structType))
+			}
+		}
+	}
+	return errs
+}
+
+// sameDiscriminant reports whether two registered discriminant values match the same JSON,
+// comparing integers exactly
+func (p *Poly) sameDiscriminant(a, b any) bool {
+	if x, ok := p.exactInteger(a); ok {
+		if y, ok := p.exactInteger(b); ok {
+			return x.Cmp(y) == 0
+		}
+	}
+	return p.discriminantMatches(a, b)
+}
+
+// CheckType walks the type of ptr, through struct fields, pointers, slices, arrays, maps and the structs
+// registered for the interfaces it meets, and reports every interface other than `any` that is not
+// registered or has no registered structs, at the first field path it is reached by. Slice and array
+// elements appear as `#` in the paths, map values as `*`. Types serializing themselves are not entered
+func (p *Poly) CheckType(ptr any) error {
+	t := reflect.TypeOf(ptr)
+	if t == nil {
+		return errors.New("poly: cannot check the type of nil")
+	}
+	var errs []error
+	p.checkType(t, "", make(map[reflect.Type]bool), &errs)
+	return errors.Join(errs...)
+}
+
+// checkType appends the problems found in t, reached at the field path path, to errs.
+// seen holds the types already checked, to stop at cycles
+func (p *Poly) checkType(t reflect.Type, path string, seen map[reflect.Type]bool, errs *[]error) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Ptr:
+		p.checkType(t.Elem(), path, seen, errs)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() != reflect.Uint8 {
+			p.checkType(t.Elem(), p.checkPath(path, "#"), seen, errs)
+		}
+	case reflect.Map:
+		p.checkType(t.Elem(), p.checkPath(path, "*"), seen, errs)
+	case reflect.Interface:
+		if p.isAny(t) {
+			return
+		}
+		at := ""
+		if path != "" {
+			at = " at field path " + path
+		}
+		entry, ok := p.types[t]
+		if !ok {
+			*errs = append(*errs, fmt.Errorf("poly: interface type %s%s not registered", p.typeKey(t), at))
+			return
+		}
+		if len(entry.structTypes) == 0 {
+			*errs = append(*errs, fmt.Errorf("poly: interface %s%s has no registered structs", p.typeKey(t), at))
+		}
+		for _, structType := range entry.structTypes {
+			p.checkType(structType, path, seen, errs)
+		}
+	case reflect.Struct:
+		if reflect.PointerTo(t).Implements(polyBinderType) {
+			// a Value serializes the value it wraps in its place
+			if f, ok := t.FieldByName("V"); ok {
+				p.checkType(f.Type, path, seen, errs)
+			}
+			return
+		}
+		if p.marshalsItself(t) && p.unmarshalsItself(t) {
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !p.isVisible(f) {
+				continue
+			}
+			fieldName, ok := p.jsonFieldName(t, f)
+			if !ok {
+				continue
+			}
+			if p.isPromoted(f) {
+				p.checkType(f.Type, path, seen, errs)
+			} else {
+				p.checkType(f.Type, p.checkPath(path, joinJSONPath([]string{fieldName})), seen, errs)
+			}
+		}
+	}
+}
+
+// checkPath appends the escaped segment to the field path path
+func (p *Poly) checkPath(path string, segment string) string {
+	if path == "" {
+		return segment
+	}
+	return path + "." + segment
+}
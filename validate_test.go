@@ -0,0 +1,96 @@
+package poly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.Validate())
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*KindRect)(nil), "rect"))
+	require.NoError(t, poly.Validate())
+}
+
+func TestValidateNoStructs(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	err := poly.Validate()
+	require.ErrorContains(t, err, "poly: interface github.com/reyoung/poly.Measurable has no registered structs")
+}
+
+func TestValidateDuplicateValues(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), "circle"))
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*KindCircle)(nil), Kind("circle")))
+	err := poly.Validate()
+	require.ErrorContains(t, err, `poly: discriminant value "circle" of interface github.com/reyoung/poly.Shape is registered for both poly.Circle and poly.KindCircle`)
+}
+
+func TestValidateValueType(t *testing.T) {
+	var poly Poly
+	require.NoError(t, poly.RegisterInterface((*Shape)(nil), "type"))
+	// values not fitting the discriminant field are rejected at registration
+	err := poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), 1)
+	require.EqualError(t, err, "poly: discriminant value 1 of struct poly.Circle cannot be stored in its field of type string")
+	err = poly.RegisterStruct((*Shape)(nil), (*Circle)(nil), 1.5)
+	require.ErrorContains(t, err, "cannot be stored in its field of type string")
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*KindCircle)(nil), "circle"))
+
+	composite := &Poly{}
+	require.NoError(t, composite.RegisterInterface((*Shape)(nil), "", DiscriminantFields("kind", "sub")))
+	require.NoError(t, composite.RegisterStruct((*Shape)(nil), (*SubCircle)(nil), []any{"shape", "circle"}))
+	require.NoError(t, composite.RegisterStruct((*Shape)(nil), (*SubRect)(nil), []any{"shape", "rect"}))
+	require.NoError(t, composite.RegisterStruct((*Shape)(nil), (*SubStamp)(nil), [2]string{"tool", "circle"}))
+	err = composite.RegisterStruct((*Shape)(nil), (*SubCircle)(nil), []any{"shape", 2})
+	require.EqualError(t, err, "poly: discriminant value 2 of struct poly.SubCircle cannot be stored in its field sub of type string")
+
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	// every problem is reported
+	err = poly.Validate()
+	require.ErrorContains(t, err, "Measurable has no registered structs")
+}
+
+func TestCheckType(t *testing.T) {
+	poly := newShapePoly(t)
+	require.NoError(t, poly.RegisterInterface((*Container)(nil), "kind"))
+	require.NoError(t, poly.RegisterStruct((*Container)(nil), (*Box)(nil), "box"))
+	require.NoError(t, poly.RegisterStruct((*Container)(nil), (*Crate)(nil), "crate"))
+
+	// Crate refers back to Container, the walk stops at the cycle
+	type Shipment struct {
+		Containers []Container          `json:"containers"`
+		Labels     map[string]any       `json:"labels"`
+		Data       []byte               `json:"data"`
+		Shapes     map[string][]*Shape  `json:"shapes"`
+		Stats      *struct{ Count int } `json:"stats"`
+	}
+	require.NoError(t, poly.CheckType((*Shipment)(nil)))
+	require.NoError(t, poly.CheckType(Shipment{}))
+
+	type Scene struct {
+		Shipment
+		Items  map[string][]Measurable `json:"items"`
+		Main   Measurable              `json:"main"`
+		Pet    *Pet                    `json:"pet"`
+		Hidden Pet                     `json:"-"`
+	}
+	err := poly.CheckType(&Scene{})
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Measurable at field path items.*.# not registered\n"+
+		"poly: interface type github.com/reyoung/poly.Pet at field path pet not registered")
+
+	require.NoError(t, poly.RegisterInterface((*Measurable)(nil), "type"))
+	err = poly.CheckType((*Measurable)(nil))
+	require.EqualError(t, err, "poly: interface github.com/reyoung/poly.Measurable has no registered structs")
+	require.Error(t, poly.CheckType(nil))
+
+	// the value wrapped by a Value is checked too
+	var bare Poly
+	err = bare.CheckType((*struct{ S Value[Shape] })(nil))
+	require.EqualError(t, err, "poly: interface type github.com/reyoung/poly.Shape at field path S not registered")
+	require.NoError(t, poly.CheckType((*struct{ S Value[Shape] })(nil)))
+}
@@ -0,0 +1,78 @@
+package poly
+
+import (
+	"errors"
+	"reflect"
+)
+
+// polyBinder is implemented by wrappers that carry the Poly used to process their value
+type polyBinder interface {
+	bindPoly(p *Poly)
+}
+
+var polyBinderType = reflect.TypeOf((*polyBinder)(nil)).Elem()
+
+// bindPoly hands p to a wrapper found during traversal, so that a wrapper without a Poly of its own
+// processes its value with the registry of the enclosing pre-pass. Wrappers serialize themselves,
+// so it reports true when the traversal must not descend into val. It must run before the
+// json.Marshaler check which would otherwise skip the wrapper unbound
+func (p *Poly) bindPoly(val reflect.Value) bool {
+	if !reflect.PointerTo(val.Type()).Implements(polyBinderType) {
+		return false
+	}
+	if val.CanAddr() {
+		val.Addr().Interface().(polyBinder).bindPoly(p)
+	}
+	return true
+}
+
+// Value wraps a polymorphic value so that plain json.Marshal and json.Unmarshal process it with Poly,
+// without callers running the pre-pass. This suits structs serialized by third-party libraries
+// e.g.
+//
+//	type Request struct {
+//	    Shape poly.Value[Shape] `json:"shape"`
+//	}
+//
+// MarshalJSON stamps the discriminant and emits V; UnmarshalJSON resolves the concrete type and decodes into V.
+// Both run in strict mode and fail when Poly is nil.
+//
+// Wrappers nest: a wrapper inside the concrete value of another wrapper is serialized by encoding/json
+// calling its own MarshalJSON/UnmarshalJSON, which processes only its own V. When such an inner wrapper
+// has no Poly, the enclosing pre-pass hands it the Poly it runs with, so nested wrappers created during
+// unmarshaling need not be initialized by hand.
+type Value[T any] struct {
+	// Poly is the registry used to process V
+	Poly *Poly `json:"-"`
+
+	// V is the wrapped polymorphic value
+	V T `json:"-"`
+}
+
+// Wrap creates a Value holding v processed by p
+func Wrap[T any](p *Poly, v T) Value[T] {
+	return Value[T]{Poly: p, V: v}
+}
+
+// MarshalJSON implements json.Marshaler by stamping discriminants in V and marshaling it
+func (v Value[T]) MarshalJSON() ([]byte, error) {
+	if v.Poly == nil {
+		return nil, errors.New("poly: Value has no Poly to marshal with")
+	}
+	return v.Poly.Marshal(&v.V, true)
+}
+
+// UnmarshalJSON implements json.Unmarshaler by resolving the concrete types in V and decoding into it
+func (v *Value[T]) UnmarshalJSON(buf []byte) error {
+	if v.Poly == nil {
+		return errors.New("poly: Value has no Poly to unmarshal with")
+	}
+	return v.Poly.Unmarshal(buf, &v.V, true)
+}
+
+// bindPoly implements polyBinder, keeping a Poly that was set explicitly
+func (v *Value[T]) bindPoly(p *Poly) {
+	if v.Poly == nil {
+		v.Poly = p
+	}
+}
@@ -0,0 +1,65 @@
+package poly
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// WrappedRequest holds a Shape through a Value wrapper
+type WrappedRequest struct {
+	Name  string       `json:"name"`
+	Shape Value[Shape] `json:"shape"`
+}
+
+// Frame is a Shape implementation wrapping another Shape
+type Frame struct {
+	Type  string       `json:"type"`
+	Inner Value[Shape] `json:"inner"`
+}
+
+func TestValue(t *testing.T) {
+	poly := newShapePoly(t)
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Frame)(nil), "frame"))
+
+	// Marshal test, plain json.Marshal stamps the discriminant
+	req := &WrappedRequest{Name: "wrapped", Shape: Wrap[Shape](poly, &Circle{Radius: 10})}
+	buf, err := json.Marshal(req)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"wrapped","shape":{"type":"circle","radius":10}}`, string(buf))
+
+	// Unmarshal test, plain json.Unmarshal resolves the concrete type
+	req2 := &WrappedRequest{Shape: Value[Shape]{Poly: poly}}
+	require.NoError(t, json.Unmarshal([]byte(`{"name":"wrapped","shape":{"type":"rect","width":5,"height":3}}`), req2))
+	require.Equal(t, "wrapped", req2.Name)
+	require.Equal(t, &Rect{Type: "rect", Width: 5, Height: 3}, req2.Shape.V)
+
+	// A wrapper without Poly cannot be processed
+	_, err = json.Marshal(&WrappedRequest{Shape: Value[Shape]{V: &Circle{}}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "poly: Value has no Poly")
+	err = json.Unmarshal([]byte(`{"shape":{"type":"rect"}}`), &WrappedRequest{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "poly: Value has no Poly")
+}
+
+func TestNestedValue(t *testing.T) {
+	poly := newShapePoly(t)
+	require.NoError(t, poly.RegisterStruct((*Shape)(nil), (*Frame)(nil), "frame"))
+
+	// Marshal test, the inner wrapper gets the Poly of the outer one
+	outer := Wrap[Shape](poly, &Frame{Inner: Value[Shape]{V: &Circle{Radius: 1}}})
+	buf, err := json.Marshal(outer)
+	require.NoError(t, err)
+	require.Equal(t, `{"type":"frame","inner":{"type":"circle","radius":1}}`, string(buf))
+
+	// Unmarshal test, the inner wrapper is created by the outer one and resolved with its Poly
+	outer2 := Value[Shape]{Poly: poly}
+	require.NoError(t, json.Unmarshal(buf, &outer2))
+	frame, ok := outer2.V.(*Frame)
+	require.True(t, ok)
+	require.Equal(t, "frame", frame.Type)
+	require.Same(t, poly, frame.Inner.Poly)
+	require.Equal(t, &Circle{Type: "circle", Radius: 1}, frame.Inner.V)
+}